@@ -0,0 +1,310 @@
+/**
+ * @brief Access log (NCSA combined or JSON lines) with size based rotation
+ *
+ * @file accesslog.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ *
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along
+ * with this program; if not, write to the Free Software Foundation, Inc.,
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Access log defaults
+const (
+	ACCESS_LOG_JSON              = "json"
+	ACCESS_LOG_NCSA              = "ncsa"
+	ACCESS_LOG_MAX_FILES_DEFAULT = 5
+	REQUEST_ID_HEADER            = "X-Request-ID"
+	NCSA_TIME_FORMAT             = "02/Jan/2006:15:04:05 -0700"
+)
+
+var M_access_log string           //Access log file, not logged if empty
+var M_access_log_format string    //"json" (default) or "ncsa"
+var M_access_log_max_size int     //Rotate at size in MB, 0 - not rotated
+var M_access_log_max_files int    //Rotated files kept
+var M_access_log_file *os.File    //Current log file
+var M_access_log_size int64       //Current log file size
+var M_access_log_mutex sync.Mutex //Guard for the file
+
+//Access log record of the request
+type accessEntry struct {
+	start     time.Time
+	requestId string
+	atmiCode  int
+	bytesIn   int64
+	w         *statusWriter
+	svc       *ServiceMap //Resolved route, nil if not matched
+}
+
+//Request context key of the access log record
+type accessKey struct{}
+
+//Request body reader counting the bytes received
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+//Read and count
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+//Open access log file
+//@return error or nil
+func openAccessLog() error {
+
+	f, err := os.OpenFile(M_access_log, os.O_CREATE|os.O_WRONLY|os.O_APPEND,
+		0644)
+
+	if nil != err {
+		return fmt.Errorf("Failed to open access log [%s]: %s", M_access_log,
+			err.Error())
+	}
+
+	fi, err := f.Stat()
+
+	if nil != err {
+		f.Close()
+		return fmt.Errorf("Failed to stat access log [%s]: %s", M_access_log,
+			err.Error())
+	}
+
+	M_access_log_file = f
+	M_access_log_size = fi.Size()
+
+	return nil
+}
+
+//Validate access log settings and open the file
+//@param ac	ATMI Context
+//@return error or nil
+func initAccessLog(ac *atmi.ATMICtx) error {
+
+	if "" == M_access_log {
+		return nil
+	}
+
+	switch M_access_log_format {
+	case "":
+		M_access_log_format = ACCESS_LOG_JSON
+	case ACCESS_LOG_JSON, ACCESS_LOG_NCSA:
+	default:
+		return fmt.Errorf("Invalid access_log_format [%s], expected json or ncsa",
+			M_access_log_format)
+	}
+
+	ac.TpLogInfo("Access log [%s], format: %s, rotate at %d MB, keep %d files",
+		M_access_log, M_access_log_format, M_access_log_max_size,
+		M_access_log_max_files)
+
+	return openAccessLog()
+}
+
+//Rotate the log: file.N-1 -> file.N, ..., file -> file.1
+func rotateAccessLog() {
+
+	M_access_log_file.Close()
+	M_access_log_file = nil
+
+	for i := M_access_log_max_files - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", M_access_log, i),
+			fmt.Sprintf("%s.%d", M_access_log, i+1))
+	}
+
+	if M_access_log_max_files > 0 {
+		os.Rename(M_access_log, M_access_log+".1")
+	} else {
+		os.Remove(M_access_log)
+	}
+
+	if err := openAccessLog(); nil != err {
+		M_ac.TpLogError("%s", err.Error())
+	}
+}
+
+//Write access log line
+//@param line	record with trailing newline
+func writeAccessLog(line []byte) {
+
+	M_access_log_mutex.Lock()
+	defer M_access_log_mutex.Unlock()
+
+	if M_access_log_max_size > 0 && nil != M_access_log_file &&
+		M_access_log_size+int64(len(line)) > int64(M_access_log_max_size)*1024*1024 {
+		rotateAccessLog()
+	}
+
+	if nil == M_access_log_file {
+		return
+	}
+
+	n, err := M_access_log_file.Write(line)
+	M_access_log_size += int64(n)
+
+	if nil != err {
+		M_ac.TpLogError("Failed to write access log [%s]: %s", M_access_log,
+			err.Error())
+	}
+}
+
+//Close access log (shutdown)
+func closeAccessLog() {
+
+	M_access_log_mutex.Lock()
+	defer M_access_log_mutex.Unlock()
+
+	if nil != M_access_log_file {
+		M_access_log_file.Close()
+		M_access_log_file = nil
+	}
+}
+
+//Start access log record. Request id is taken from X-Request-ID header or
+//generated, and returned in the response. Record is passed to the route in
+//request context.
+//@param w	Response writer
+//@param req	HTTP Request
+//@return record (nil if access log is off), response writer and request to use
+func startAccess(w http.ResponseWriter, req *http.Request) (*accessEntry,
+	http.ResponseWriter, *http.Request) {
+
+	if "" == M_access_log {
+		return nil, w, req
+	}
+
+	e := &accessEntry{start: time.Now(), requestId: req.Header.Get(REQUEST_ID_HEADER),
+		w: &statusWriter{ResponseWriter: w}}
+
+	if "" == e.requestId {
+		e.requestId = traceRandomId(16)
+	}
+
+	e.w.Header().Set(REQUEST_ID_HEADER, e.requestId)
+
+	if nil != req.Body {
+		req.Body = &countingReader{ReadCloser: req.Body, n: &e.bytesIn}
+	}
+
+	return e, e.w, req.WithContext(context.WithValue(req.Context(), accessKey{}, e))
+}
+
+//Get access log record of the request
+//@param req	HTTP Request
+//@return record or nil
+func getAccess(req *http.Request) *accessEntry {
+
+	e, _ := req.Context().Value(accessKey{}).(*accessEntry)
+
+	return e
+}
+
+//Record ATMI result of the request
+//@param code	ATMI error code (TPMINVAL on success)
+func (e *accessEntry) setResult(code int) {
+
+	if nil != e {
+		e.atmiCode = code
+	}
+}
+
+//Complete and write the access log record
+//@param e	record
+//@param req	HTTP Request
+func endAccess(e *accessEntry, req *http.Request) {
+
+	latency := time.Since(e.start)
+	status := e.w.status
+
+	if 0 == status {
+		status = http.StatusOK
+	}
+
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+
+	if nil != err {
+		ip = req.RemoteAddr
+	}
+
+	svc := e.svc
+
+	if nil == svc {
+		svc = &ServiceMap{}
+	}
+
+	var line []byte
+
+	if ACCESS_LOG_NCSA == M_access_log_format {
+		line = []byte(fmt.Sprintf("%s - - [%s] %s %d %d %s %s route=%s svc=%s "+
+			"conv=%s atmi=%d in=%d ms=%.3f reqid=%s\n",
+			ip, e.start.Format(NCSA_TIME_FORMAT),
+			strconv.Quote(req.Method+" "+req.RequestURI+" "+req.Proto), status,
+			e.w.bytes, strconv.Quote(req.Referer()),
+			strconv.Quote(req.UserAgent()), strconv.Quote(svc.Url),
+			strconv.Quote(svc.Svc), strconv.Quote(svc.Conv), e.atmiCode, e.bytesIn,
+			float64(latency.Microseconds())/1000, strconv.Quote(e.requestId)))
+	} else {
+		line, _ = json.Marshal(map[string]interface{}{
+			"time":       e.start.Format(time.RFC3339Nano),
+			"client_ip":  ip,
+			"method":     req.Method,
+			"url":        req.RequestURI,
+			"proto":      req.Proto,
+			"route":      svc.Url,
+			"service":    svc.Svc,
+			"conv":       svc.Conv,
+			"atmi_code":  e.atmiCode,
+			"status":     status,
+			"bytes_in":   e.bytesIn,
+			"bytes_out":  e.w.bytes,
+			"latency_ms": float64(latency.Microseconds()) / 1000,
+			"request_id": e.requestId,
+			"user_agent": req.UserAgent(),
+		})
+		line = append(line, '\n')
+	}
+
+	writeAccessLog(line)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
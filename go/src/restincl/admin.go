@@ -0,0 +1,86 @@
+/**
+ * @brief Admin listener (metrics, health)
+ *
+ * @file admin.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+var M_admin_port int = atmi.FAIL //Admin listener port, not used if not set
+var M_admin_ip string            //Admin listener IP, defaults to "ip"
+var M_admin_server *http.Server
+
+//Start admin listener, if configured
+//@param ac	ATMI Context
+func startAdmin(ac *atmi.ATMICtx) {
+
+	if M_admin_port <= 0 {
+		return
+	}
+
+	ip := M_admin_ip
+
+	if "" == ip {
+		ip = M_ip
+	}
+
+	listenOn := fmt.Sprintf("%s:%d", ip, M_admin_port)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+
+	M_admin_server = &http.Server{Addr: listenOn, Handler: mux}
+
+	ac.TpLogInfo("About to listen admin on: %s", listenOn)
+
+	go func() {
+		if err := M_admin_server.ListenAndServe(); http.ErrServerClosed != err {
+			ac.TpLogError("Admin ListenAndServe() failed: %s", err)
+		}
+	}()
+}
+
+//Stop admin listener
+func stopAdmin() {
+
+	if nil != M_admin_server {
+		M_admin_server.Close()
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,842 @@
+/**
+ * @brief Request authentication: HTTP Basic (htpasswd), Bearer JWT (JWKS)
+ *  and static API keys
+ *
+ * @file auth.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//Authentication types
+const (
+	AUTH_NONE   = "none"
+	AUTH_BASIC  = "basic"
+	AUTH_JWT    = "jwt"
+	AUTH_APIKEY = "apikey"
+)
+
+//Defaults
+const (
+	AUTH_REALM_DEFAULT  = "restincl"
+	AUTH_HEADER_DEFAULT = "X-API-Key"
+	JWT_LEEWAY          = 60 //Clock skew allowed for exp/nbf, seconds
+)
+
+//Authenticated caller
+type AuthResult struct {
+	Principal string                 //User name, API key name or JWT subject
+	Claims    map[string]interface{} //JWT claims (if any)
+}
+
+//Authentication provider
+type Authenticator interface {
+	//Authenticate the request, return error if credentials missing or invalid
+	Authenticate(req *http.Request) (*AuthResult, error)
+	//Value for WWW-Authenticate header
+	Challenge() string
+}
+
+//Loaded providers, shared between routes with the same settings
+var M_auth_cache = make(map[string]Authenticator)
+
+////////////////////////////////////////////////////////////////////////////////
+// HTTP Basic
+////////////////////////////////////////////////////////////////////////////////
+
+//HTTP Basic against htpasswd file
+type basicAuth struct {
+	realm string
+	users map[string]string //user -> password hash
+}
+
+//Load htpasswd file. Supported hashes: bcrypt ($2y$, $2a$, $2b$),
+//Apache MD5 ($apr1$) and SHA1 ({SHA})
+//@param path	file name
+//@return user -> hash map or error
+func loadHtpasswd(path string) (map[string]string, error) {
+
+	f, err := os.Open(path)
+
+	if nil != err {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+
+		line := strings.TrimSpace(scanner.Text())
+
+		if "" == line || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pair := strings.SplitN(line, ":", 2)
+
+		if 2 != len(pair) {
+			return nil, fmt.Errorf("Invalid htpasswd line: [%s]", line)
+		}
+
+		users[pair[0]] = pair[1]
+	}
+
+	return users, scanner.Err()
+}
+
+//Apache MD5 crypt
+//@param password	password to hash
+//@param salt	salt (up to 8 chars)
+//@return hash in $apr1$salt$hash format
+func apr1Crypt(password string, salt string) string {
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	const magic = "$apr1$"
+
+	pw := []byte(password)
+	sl := []byte(salt)
+
+	if len(sl) > 8 {
+		sl = sl[:8]
+	}
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write(sl)
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic))
+	ctx.Write(sl)
+
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:i])
+		}
+	}
+
+	for i := len(pw); i > 0; i >>= 1 {
+		if 0 != i&1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+
+		if 0 != i&1 {
+			c.Write(pw)
+		} else {
+			c.Write(final)
+		}
+
+		if 0 != i%3 {
+			c.Write(sl)
+		}
+
+		if 0 != i%7 {
+			c.Write(pw)
+		}
+
+		if 0 != i&1 {
+			c.Write(final)
+		} else {
+			c.Write(pw)
+		}
+
+		final = c.Sum(nil)
+	}
+
+	out := []byte{}
+	enc := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+
+	enc(final[0], final[6], final[12], 4)
+	enc(final[1], final[7], final[13], 4)
+	enc(final[2], final[8], final[14], 4)
+	enc(final[3], final[9], final[15], 4)
+	enc(final[4], final[10], final[5], 4)
+	enc(0, 0, final[11], 2)
+
+	return magic + string(sl) + "$" + string(out)
+}
+
+//Verify password against htpasswd hash
+//@param hashed	hash from file
+//@param password	password provided
+//@return true if matches
+func htpasswdMatch(hashed string, password string) bool {
+
+	switch {
+	case strings.HasPrefix(hashed, "$2y$") || strings.HasPrefix(hashed, "$2a$") ||
+		strings.HasPrefix(hashed, "$2b$"):
+		return nil == bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
+	case strings.HasPrefix(hashed, "$apr1$"):
+		parts := strings.Split(hashed, "$")
+		if len(parts) != 4 {
+			return false
+		}
+		return 1 == subtle.ConstantTimeCompare([]byte(hashed),
+			[]byte(apr1Crypt(password, parts[2])))
+	case strings.HasPrefix(hashed, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return 1 == subtle.ConstantTimeCompare([]byte(hashed[5:]),
+			[]byte(base64.StdEncoding.EncodeToString(sum[:])))
+	}
+
+	return false
+}
+
+//Authenticate by HTTP Basic
+func (a *basicAuth) Authenticate(req *http.Request) (*AuthResult, error) {
+
+	user, password, ok := req.BasicAuth()
+
+	if !ok {
+		return nil, errors.New("Basic credentials not provided")
+	}
+
+	hashed, ok := a.users[user]
+
+	if !ok || !htpasswdMatch(hashed, password) {
+		return nil, fmt.Errorf("Invalid credentials for user [%s]", user)
+	}
+
+	return &AuthResult{Principal: user}, nil
+}
+
+//Basic challenge
+func (a *basicAuth) Challenge() string {
+	return fmt.Sprintf("Basic realm=\"%s\"", a.realm)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// API keys
+////////////////////////////////////////////////////////////////////////////////
+
+//Static API keys
+type apikeyAuth struct {
+	header string
+	keys   map[string]string //key -> principal
+}
+
+//Load API key file. Format: one key per line, optionally followed by
+//whitespace and principal name (key is used as principal if not set)
+//@param path	file name
+//@return key -> principal map or error
+func loadAPIKeys(path string) (map[string]string, error) {
+
+	f, err := os.Open(path)
+
+	if nil != err {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+
+		fields := strings.Fields(scanner.Text())
+
+		if 0 == len(fields) || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) > 1 {
+			keys[fields[0]] = fields[1]
+		} else {
+			keys[fields[0]] = fields[0]
+		}
+	}
+
+	return keys, scanner.Err()
+}
+
+//Authenticate by API key header
+func (a *apikeyAuth) Authenticate(req *http.Request) (*AuthResult, error) {
+
+	key := req.Header.Get(a.header)
+
+	if "" == key {
+		return nil, fmt.Errorf("API key header [%s] not provided", a.header)
+	}
+
+	for k, principal := range a.keys {
+		if 1 == subtle.ConstantTimeCompare([]byte(k), []byte(key)) {
+			return &AuthResult{Principal: principal}, nil
+		}
+	}
+
+	return nil, errors.New("Invalid API key")
+}
+
+//API key challenge (non standard)
+func (a *apikeyAuth) Challenge() string {
+	return ""
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// JWT
+////////////////////////////////////////////////////////////////////////////////
+
+//JSON Web Key
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	K   string `json:"k"`   //oct
+	N   string `json:"n"`   //RSA
+	E   string `json:"e"`   //RSA
+	Crv string `json:"crv"` //EC
+	X   string `json:"x"`   //EC
+	Y   string `json:"y"`   //EC
+
+	secret []byte
+	rsaKey *rsa.PublicKey
+	ecKey  *ecdsa.PublicKey
+}
+
+//Bearer JWT validated by local JWKS
+type jwtAuth struct {
+	keys        []*jwk
+	iss         string
+	aud         string
+	expOptional bool //Accept tokens without exp claim
+}
+
+//Curve required by the ES algorithm (RFC 7518, 3.4)
+var M_jwt_es_curves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+//Decode base64url (no padding)
+func b64url(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+//Load JWKS file
+//@param path	file name
+//@return list of keys or error
+func loadJWKS(path string) ([]*jwk, error) {
+
+	data, err := ioutil.ReadFile(path)
+
+	if nil != err {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+
+	if err := json.Unmarshal(data, &set); nil != err {
+		return nil, fmt.Errorf("Invalid JWKS: %s", err.Error())
+	}
+
+	for _, k := range set.Keys {
+
+		switch k.Kty {
+		case "oct":
+			if k.secret, err = b64url(k.K); nil != err {
+				return nil, fmt.Errorf("Invalid oct key [%s]: %s", k.Kid, err)
+			}
+		case "RSA":
+			n, err1 := b64url(k.N)
+			e, err2 := b64url(k.E)
+
+			if nil != err1 || nil != err2 {
+				return nil, fmt.Errorf("Invalid RSA key [%s]", k.Kid)
+			}
+
+			k.rsaKey = &rsa.PublicKey{N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("Unsupported EC curve [%s] for key [%s]",
+					k.Crv, k.Kid)
+			}
+
+			x, err1 := b64url(k.X)
+			y, err2 := b64url(k.Y)
+
+			if nil != err1 || nil != err2 {
+				return nil, fmt.Errorf("Invalid EC key [%s]", k.Kid)
+			}
+
+			k.ecKey = &ecdsa.PublicKey{Curve: curve,
+				X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		default:
+			return nil, fmt.Errorf("Unsupported key type [%s] for key [%s]",
+				k.Kty, k.Kid)
+		}
+	}
+
+	if 0 == len(set.Keys) {
+		return nil, errors.New("No keys in JWKS")
+	}
+
+	return set.Keys, nil
+}
+
+//Verify JWT signature with the key
+//@param k	key
+//@param alg	JWT algorithm
+//@param signed	header.payload
+//@param sig	signature
+//@return nil if valid
+func (k *jwk) verify(alg string, signed string, sig []byte) error {
+
+	var hf func() hash.Hash
+	var ch crypto.Hash
+
+	switch alg[2:] {
+	case "256":
+		hf, ch = sha256.New, crypto.SHA256
+	case "384":
+		hf, ch = sha512.New384, crypto.SHA384
+	case "512":
+		hf, ch = sha512.New, crypto.SHA512
+	default:
+		return fmt.Errorf("Unsupported algorithm [%s]", alg)
+	}
+
+	switch alg[:2] {
+	case "HS":
+		if nil == k.secret {
+			return errors.New("Key type mismatch")
+		}
+		mac := hmac.New(hf, k.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errors.New("Invalid signature")
+		}
+	case "RS":
+		if nil == k.rsaKey {
+			return errors.New("Key type mismatch")
+		}
+		h := hf()
+		h.Write([]byte(signed))
+		if err := rsa.VerifyPKCS1v15(k.rsaKey, ch, h.Sum(nil), sig); nil != err {
+			return errors.New("Invalid signature")
+		}
+	case "ES":
+		if nil == k.ecKey || M_jwt_es_curves[alg] != k.Crv {
+			return errors.New("Key type mismatch")
+		}
+		//Signature is R | S, each padded to the curve size
+		size := (k.ecKey.Curve.Params().BitSize + 7) / 8
+		if 2*size != len(sig) {
+			return errors.New("Invalid signature length")
+		}
+		h := hf()
+		h.Write([]byte(signed))
+		r := new(big.Int).SetBytes(sig[:len(sig)/2])
+		s := new(big.Int).SetBytes(sig[len(sig)/2:])
+		if !ecdsa.Verify(k.ecKey, h.Sum(nil), r, s) {
+			return errors.New("Invalid signature")
+		}
+	default:
+		return fmt.Errorf("Unsupported algorithm [%s]", alg)
+	}
+
+	return nil
+}
+
+//Get numeric date claim
+//@param claims	JWT claims
+//@param name	claim name
+//@return value and true if present
+func jwtTime(claims map[string]interface{}, name string) (int64, bool) {
+
+	if v, ok := claims[name].(float64); ok {
+		return int64(v), true
+	}
+
+	return 0, false
+}
+
+//Authenticate by Bearer JWT
+func (a *jwtAuth) Authenticate(req *http.Request) (*AuthResult, error) {
+
+	authz := req.Header.Get("Authorization")
+
+	if !strings.HasPrefix(authz, "Bearer ") {
+		return nil, errors.New("Bearer token not provided")
+	}
+
+	parts := strings.Split(strings.TrimSpace(authz[7:]), ".")
+
+	if 3 != len(parts) {
+		return nil, errors.New("Malformed JWT")
+	}
+
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	hdrData, err := b64url(parts[0])
+
+	if nil != err || nil != json.Unmarshal(hdrData, &hdr) || len(hdr.Alg) < 5 {
+		return nil, errors.New("Malformed JWT header")
+	}
+
+	sig, err := b64url(parts[2])
+
+	if nil != err {
+		return nil, errors.New("Malformed JWT signature")
+	}
+
+	signed := parts[0] + "." + parts[1]
+	verified := false
+
+	for _, k := range a.keys {
+
+		if ("" != hdr.Kid && hdr.Kid != k.Kid) || ("" != k.Alg && hdr.Alg != k.Alg) {
+			continue
+		}
+
+		if nil == k.verify(hdr.Alg, signed, sig) {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, fmt.Errorf("JWT signature not verified (alg %s, kid [%s])",
+			hdr.Alg, hdr.Kid)
+	}
+
+	payload, err := b64url(parts[1])
+
+	if nil != err {
+		return nil, errors.New("Malformed JWT payload")
+	}
+
+	claims := make(map[string]interface{})
+
+	if err := json.Unmarshal(payload, &claims); nil != err {
+		return nil, errors.New("Malformed JWT claims")
+	}
+
+	now := time.Now().Unix()
+
+	if exp, ok := jwtTime(claims, "exp"); !ok && !a.expOptional {
+		return nil, errors.New("JWT has no exp claim")
+	} else if ok && now > exp+JWT_LEEWAY {
+		return nil, errors.New("JWT expired")
+	}
+
+	if nbf, ok := jwtTime(claims, "nbf"); ok && now < nbf-JWT_LEEWAY {
+		return nil, errors.New("JWT not valid yet")
+	}
+
+	if "" != a.iss {
+		if iss, _ := claims["iss"].(string); iss != a.iss {
+			return nil, fmt.Errorf("JWT issuer [%s] not accepted", iss)
+		}
+	}
+
+	if "" != a.aud && !jwtHasAudience(claims["aud"], a.aud) {
+		return nil, fmt.Errorf("JWT audience [%v] not accepted", claims["aud"])
+	}
+
+	sub, _ := claims["sub"].(string)
+
+	if "" == sub {
+		return nil, errors.New("JWT has no sub claim")
+	}
+
+	return &AuthResult{Principal: sub, Claims: claims}, nil
+}
+
+//Check the audience claim (string or array)
+//@param aud	audience claim
+//@param expected	expected audience
+//@return true if matched
+func jwtHasAudience(aud interface{}, expected string) bool {
+
+	switch v := aud.(type) {
+	case string:
+		return v == expected
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == expected {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//Bearer challenge
+func (a *jwtAuth) Challenge() string {
+	return "Bearer"
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Route settings & request processing
+////////////////////////////////////////////////////////////////////////////////
+
+//Load (or get from cache) the authentication provider of the route
+//@param ac	ATMI Context
+//@param svc	Service map
+//@return error or nil
+func initAuth(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	svc.Auth_prov = nil
+
+	if "" == svc.Auth || AUTH_NONE == svc.Auth {
+		return nil
+	}
+
+	if "" == svc.Auth_file {
+		return fmt.Errorf("Route [%s]: 'auth_file' must be set for '%s' auth",
+			svc.Url, svc.Auth)
+	}
+
+	key := strings.Join([]string{svc.Auth, svc.Auth_file, svc.Auth_realm,
+		svc.Auth_header, svc.Auth_jwt_iss, svc.Auth_jwt_aud,
+		strconv.FormatBool(svc.Auth_jwt_exp_optional)}, "|")
+
+	if prov, ok := M_auth_cache[key]; ok {
+		svc.Auth_prov = prov
+		return nil
+	}
+
+	switch svc.Auth {
+	case AUTH_BASIC:
+		users, err := loadHtpasswd(svc.Auth_file)
+
+		if nil != err {
+			return fmt.Errorf("Route [%s]: failed to load htpasswd [%s]: %s",
+				svc.Url, svc.Auth_file, err.Error())
+		}
+
+		realm := svc.Auth_realm
+
+		if "" == realm {
+			realm = AUTH_REALM_DEFAULT
+		}
+
+		ac.TpLogInfo("Loaded %d users from [%s]", len(users), svc.Auth_file)
+		svc.Auth_prov = &basicAuth{realm: realm, users: users}
+	case AUTH_JWT:
+		keys, err := loadJWKS(svc.Auth_file)
+
+		if nil != err {
+			return fmt.Errorf("Route [%s]: failed to load JWKS [%s]: %s",
+				svc.Url, svc.Auth_file, err.Error())
+		}
+
+		ac.TpLogInfo("Loaded %d keys from [%s]", len(keys), svc.Auth_file)
+		svc.Auth_prov = &jwtAuth{keys: keys, iss: svc.Auth_jwt_iss,
+			aud: svc.Auth_jwt_aud, expOptional: svc.Auth_jwt_exp_optional}
+	case AUTH_APIKEY:
+		keys, err := loadAPIKeys(svc.Auth_file)
+
+		if nil != err {
+			return fmt.Errorf("Route [%s]: failed to load API keys [%s]: %s",
+				svc.Url, svc.Auth_file, err.Error())
+		}
+
+		header := svc.Auth_header
+
+		if "" == header {
+			header = AUTH_HEADER_DEFAULT
+		}
+
+		ac.TpLogInfo("Loaded %d API keys from [%s]", len(keys), svc.Auth_file)
+		svc.Auth_prov = &apikeyAuth{header: header, keys: keys}
+	default:
+		return fmt.Errorf("Route [%s]: unsupported auth [%s]", svc.Url, svc.Auth)
+	}
+
+	M_auth_cache[key] = svc.Auth_prov
+
+	return nil
+}
+
+//Authenticate & authorize the request
+//@param ac	ATMI Context
+//@param svc	Service map
+//@param w	Response writer
+//@param req	HTTP Request
+//@return auth result or error (TPEPERM with HTTP 401 or 403)
+func authenticate(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	req *http.Request) (*AuthResult, atmi.ATMIError) {
+
+	res, err := svc.Auth_prov.Authenticate(req)
+
+	if nil != err {
+		ac.TpLogWarn("URL [%s] caller %s: authentication failed: %s",
+			req.URL, req.RemoteAddr, err.Error())
+
+		if challenge := svc.Auth_prov.Challenge(); "" != challenge {
+			w.Header().Set("WWW-Authenticate", challenge)
+		}
+
+		return nil, NewHTTPError(atmi.TPEPERM, "Authentication failed",
+			http.StatusUnauthorized)
+	}
+
+	if len(svc.Auth_allow) > 0 {
+
+		allowed := false
+
+		for _, p := range svc.Auth_allow {
+			if p == res.Principal {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			ac.TpLogWarn("URL [%s] caller %s: principal [%s] not allowed",
+				req.URL, req.RemoteAddr, res.Principal)
+			return nil, NewHTTPError(atmi.TPEPERM, "Access denied",
+				http.StatusForbidden)
+		}
+	}
+
+	ac.TpLogInfo("URL [%s] authenticated principal [%s]", req.URL, res.Principal)
+
+	return res, nil
+}
+
+//Convert claim value to strings (arrays are converted to multiple values)
+//@param v	claim value
+//@return string values
+func claimStrings(v interface{}) []string {
+
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{t}
+	case float64:
+		return []string{strconv.FormatFloat(t, 'f', -1, 64)}
+	case bool:
+		return []string{strconv.FormatBool(t)}
+	case []interface{}:
+		ret := []string{}
+		for _, e := range t {
+			ret = append(ret, claimStrings(e)...)
+		}
+		return ret
+	default:
+		b, _ := json.Marshal(t)
+		return []string{string(b)}
+	}
+}
+
+//Add principal & claims to request fields. Fields of missing values are
+//cleared, so that client cannot set them.
+//@param svc	Service map
+//@param res	Authentication result
+//@param fields	target field/key names to values
+func getAuthFields(svc *ServiceMap, res *AuthResult, fields map[string][]string) {
+
+	if nil == res {
+		res = &AuthResult{}
+	}
+
+	if "" != svc.Auth_field {
+		fields[svc.Auth_field] = nil
+
+		if "" != res.Principal {
+			fields[svc.Auth_field] = []string{res.Principal}
+		}
+	}
+
+	for claim, fld := range svc.Auth_claims {
+		fields[fld] = claimStrings(res.Claims[claim])
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,180 @@
+/**
+ * @brief Authorization delegated to XATMI service
+ *
+ * @file authsvc.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"net"
+	"net/http"
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Build authorization request buffer: URL, method, client IP, headers and
+//cookies
+//@param ac	ATMI Context
+//@param req	HTTP Request
+//@return UBF buffer or error
+func newAuthSvcBuf(ac *atmi.ATMICtx, req *http.Request) (*atmi.TypedUBF, atmi.ATMIError) {
+
+	bufu, err := ac.NewUBF(atmi.ATMIMsgSizeMax())
+
+	if nil != err {
+		ac.TpLogError("Failed to alloc auth UBF buffer %d:[%s]",
+			err.Code(), err.Message())
+		return nil, err
+	}
+
+	clientIP, _, errA := net.SplitHostPort(req.RemoteAddr)
+
+	if nil != errA {
+		clientIP = req.RemoteAddr
+	}
+
+	if err := bufu.BChg(ubftab.EX_IF_URL, 0, req.URL.String()); nil != err {
+		return nil, err
+	}
+
+	if err := bufu.BChg(ubftab.EX_IF_METHOD, 0, req.Method); nil != err {
+		return nil, err
+	}
+
+	if err := bufu.BChg(ubftab.EX_IF_CLIENTIP, 0, clientIP); nil != err {
+		return nil, err
+	}
+
+	//Each header value goes in separate name/value pair
+	for k, vals := range req.Header {
+		for _, v := range vals {
+			bufu.BAdd(ubftab.EX_IF_REQHN, k)
+			bufu.BAdd(ubftab.EX_IF_REQHV, v)
+		}
+	}
+
+	for _, cookie := range req.Cookies() {
+		bufu.BAdd(ubftab.EX_IF_REQCN, cookie.Name)
+		bufu.BAdd(ubftab.EX_IF_REQCV, cookie.Value)
+	}
+
+	return bufu, nil
+}
+
+//Call authorization service of the route. If service returns TPFAIL, the
+//request is rejected with 401 (if service has set "WWW-Authenticate" response
+//header) or 403. Headers set by service (EX_IF_RSPHN/EX_IF_RSPHV) are sent
+//to caller. On success fields listed in authsvc_fields are copied to request.
+//@param ac	ATMI Context
+//@param svc	Service map
+//@param w	Response writer
+//@param req	HTTP Request
+//@param fields	target field/key names to values
+//@return nil if authorized
+func callAuthSvc(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	req *http.Request, fields map[string][]string) atmi.ATMIError {
+
+	var flags int64 = 0
+
+	bufu, err := newAuthSvcBuf(ac, req)
+
+	if nil != err {
+		return err
+	}
+
+	if svc.Notime {
+		flags |= atmi.TPNOTIME
+	}
+
+	bufu.TpLogPrintUBF(atmi.LOG_DEBUG, "Calling auth service with")
+
+	if _, err = ac.TpCall(svc.Authsvc, bufu, flags); nil != err {
+
+		if atmi.TPESVCFAIL != err.Code() {
+			ac.TpLogError("Auth service [%s] call failed: %d:[%s]",
+				svc.Authsvc, err.Code(), err.Message())
+			return err
+		}
+
+		status := http.StatusForbidden
+		occs, _ := bufu.BOccur(ubftab.EX_IF_RSPHN)
+
+		for occ := 0; occ < occs; occ++ {
+
+			name, err1 := bufu.BGetString(ubftab.EX_IF_RSPHN, occ)
+			value, err2 := bufu.BGetString(ubftab.EX_IF_RSPHV, occ)
+
+			if nil != err1 || nil != err2 {
+				continue
+			}
+
+			w.Header().Set(name, value)
+
+			if "WWW-Authenticate" == http.CanonicalHeaderKey(name) {
+				status = http.StatusUnauthorized
+			}
+		}
+
+		ac.TpLogWarn("URL [%s] caller %s: rejected by auth service [%s] (%d)",
+			req.URL, req.RemoteAddr, svc.Authsvc, status)
+
+		return NewHTTPError(atmi.TPEPERM, "Access denied", status)
+	}
+
+	for src, dst := range svc.Authsvc_fields {
+
+		id, err1 := ac.BFldId(src)
+
+		if nil != err1 {
+			ac.TpLogError("Auth service field [%s] not found: %s",
+				src, err1.Message())
+			return err1
+		}
+
+		occs, _ := bufu.BOccur(id)
+		vals := []string{}
+
+		for occ := 0; occ < occs; occ++ {
+			if val, err1 := bufu.BGetString(id, occ); nil == err1 {
+				vals = append(vals, val)
+			}
+		}
+
+		ac.TpLogDebug("Auth service field [%s] -> [%s]: %v", src, dst, vals)
+		fields[dst] = vals
+	}
+
+	ac.TpLogInfo("URL [%s] authorized by [%s]", req.URL, svc.Authsvc)
+
+	return nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,153 @@
+/**
+ * @brief Request body size limit and HTTP server time-outs
+ *
+ * @file bodylimit.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Defaults
+const (
+	READ_HEADER_TIMEOUT_DEFAULT = 30  //Seconds
+	IDLE_TIMEOUT_DEFAULT        = 120 //Seconds
+)
+
+//HTTP server limits (seconds), 0 - not limited
+var M_read_timeout int
+var M_read_header_timeout int
+var M_write_timeout int
+var M_idle_timeout int
+var M_max_header_bytes int //0 - Go default (1 MB)
+var M_max_body_size int    //Request body limit of routes not setting own
+
+//Request body limited by http.MaxBytesReader, which records if the limit
+//was exceeded
+type maxBodyReader struct {
+	io.ReadCloser
+	exceeded bool
+}
+
+//Read the body, track the limit
+func (m *maxBodyReader) Read(p []byte) (int, error) {
+
+	n, err := m.ReadCloser.Read(p)
+
+	if nil != err && errors.As(err, new(*http.MaxBytesError)) {
+		m.exceeded = true
+	}
+
+	return n, err
+}
+
+//Get request body limit of the route
+//@param svc	Service map
+//@return limit in bytes, 0 - not limited
+func maxBodySize(svc *ServiceMap) int {
+
+	if svc.Max_body_size > 0 {
+		return svc.Max_body_size
+	} else if M_max_body_size > 0 {
+		return M_max_body_size
+	}
+
+	return 0
+}
+
+//Install max_body_size limit of the route for the request body
+//@param ac	ATMI Context
+//@param svc	Service map
+//@param w	Response writer
+//@param req	HTTP Request
+//@return error (HTTP 413) if body is known to be too large, or nil
+func limitRequestBody(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter,
+	req *http.Request) atmi.ATMIError {
+
+	limit := int64(maxBodySize(svc))
+
+	if limit <= 0 {
+		return nil
+	}
+
+	if req.ContentLength > limit {
+		ac.TpLogError("Request body %d bytes exceeds max_body_size %d",
+			req.ContentLength, limit)
+		return errBodyTooLarge()
+	}
+
+	req.Body = &maxBodyReader{ReadCloser: http.MaxBytesReader(w, req.Body, limit)}
+
+	return nil
+}
+
+//Check if request body read failed due to max_body_size
+//@param req	HTTP Request
+//@return true if limit exceeded
+func bodyLimitExceeded(req *http.Request) bool {
+
+	if m, ok := req.Body.(*maxBodyReader); ok {
+		return m.exceeded
+	}
+
+	return false
+}
+
+//Error for too large request body
+//@return error with HTTP 413 status
+func errBodyTooLarge() atmi.ATMIError {
+	return NewHTTPError(atmi.TPELIMIT, "Request body too large",
+		http.StatusRequestEntityTooLarge)
+}
+
+//Apply time-outs and header size limit to HTTP server
+//@param ac	ATMI Context
+//@param server	HTTP server
+func applyServerLimits(ac *atmi.ATMICtx, server *http.Server) {
+
+	server.ReadTimeout = time.Duration(M_read_timeout) * time.Second
+	server.ReadHeaderTimeout = time.Duration(M_read_header_timeout) * time.Second
+	server.WriteTimeout = time.Duration(M_write_timeout) * time.Second
+	server.IdleTimeout = time.Duration(M_idle_timeout) * time.Second
+	server.MaxHeaderBytes = M_max_header_bytes
+
+	ac.TpLogInfo("HTTP server time-outs: read %d, read header %d, write %d, "+
+		"idle %d sec, max header bytes: %d", M_read_timeout,
+		M_read_header_timeout, M_write_timeout, M_idle_timeout,
+		M_max_header_bytes)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
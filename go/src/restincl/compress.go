@@ -0,0 +1,309 @@
+/**
+ * @brief Request body decoding and response compression (gzip, deflate, br)
+ *
+ * @file compress.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Content codings
+const (
+	ENCODING_GZIP    = "gzip"
+	ENCODING_DEFLATE = "deflate"
+	ENCODING_BR      = "br"
+)
+
+//Defaults
+const (
+	COMPRESS_MIN_SIZE_DEFAULT = 1024 //Bytes
+)
+
+//Response encodings in server preference order
+var M_rsp_encodings = []string{ENCODING_BR, ENCODING_GZIP, ENCODING_DEFLATE}
+
+//Body reader with decoder to close
+type decodedBody struct {
+	io.Reader
+	body    io.ReadCloser
+	decoder io.Closer
+}
+
+//Close decoder and original body
+func (d *decodedBody) Close() error {
+	if nil != d.decoder {
+		d.decoder.Close()
+	}
+	return d.body.Close()
+}
+
+//Install decoder for Content-Encoding of the request body. "deflate" is
+//accepted both in zlib and raw format.
+//@param ac	ATMI Context
+//@param req	HTTP Request
+//@return error (HTTP 415 for unsupported coding, 400 for invalid data) or nil
+func decodeRequestBody(ac *atmi.ATMICtx, req *http.Request) atmi.ATMIError {
+
+	encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+
+	if "" == encoding || "identity" == encoding {
+		return nil
+	}
+
+	ac.TpLogDebug("Decoding request body: [%s]", encoding)
+
+	var reader io.Reader
+	var decoder io.Closer
+
+	switch encoding {
+	case ENCODING_GZIP, "x-gzip":
+		zr, err := gzip.NewReader(req.Body)
+
+		if nil != err {
+			ac.TpLogError("Invalid gzip request body: %s", err.Error())
+			return NewHTTPError(atmi.TPEINVAL, "Invalid gzip request body",
+				http.StatusBadRequest)
+		}
+
+		reader, decoder = zr, zr
+	case ENCODING_DEFLATE:
+		br := bufio.NewReader(req.Body)
+		hdr, _ := br.Peek(2)
+
+		//zlib header: CM=8 and check bits
+		if 2 == len(hdr) && 8 == hdr[0]&0x0f && 0 == (uint(hdr[0])<<8|uint(hdr[1]))%31 {
+			zr, err := zlib.NewReader(br)
+
+			if nil != err {
+				ac.TpLogError("Invalid deflate request body: %s", err.Error())
+				return NewHTTPError(atmi.TPEINVAL, "Invalid deflate request body",
+					http.StatusBadRequest)
+			}
+
+			reader, decoder = zr, zr
+		} else {
+			fr := flate.NewReader(br)
+			reader, decoder = fr, fr
+		}
+	case ENCODING_BR:
+		reader = brotli.NewReader(req.Body)
+	default:
+		ac.TpLogError("Unsupported request Content-Encoding: [%s]", encoding)
+		return NewHTTPError(atmi.TPEINVAL, "Unsupported Content-Encoding",
+			http.StatusUnsupportedMediaType)
+	}
+
+	req.Body = &decodedBody{Reader: reader, body: req.Body, decoder: decoder}
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Content-Length")
+	req.ContentLength = -1
+
+	return nil
+}
+
+//Select response encoding from Accept-Encoding
+//@param accept	Accept-Encoding header value
+//@return encoding or empty string if response shall not be compressed
+func negotiateEncoding(accept string) string {
+
+	accepted := make(map[string]bool)
+
+	for _, part := range strings.Split(accept, ",") {
+
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		if "" == coding {
+			continue
+		}
+
+		q := 1.0
+
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); nil == err {
+					q = v
+				}
+			}
+		}
+
+		accepted[coding] = q > 0
+	}
+
+	for _, enc := range M_rsp_encodings {
+		if ok, set := accepted[enc]; set {
+			if ok {
+				return enc
+			}
+		} else if accepted["*"] {
+			return enc
+		}
+	}
+
+	return ""
+}
+
+//Compress data
+//@param encoding	content coding
+//@param data	data to compress
+//@return compressed data or error
+func compressBody(encoding string, data []byte) ([]byte, error) {
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+
+	switch encoding {
+	case ENCODING_GZIP:
+		w = gzip.NewWriter(&buf)
+	case ENCODING_DEFLATE:
+		w, err = zlib.NewWriterLevel(&buf, zlib.DefaultCompression)
+	case ENCODING_BR:
+		w = brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+	}
+
+	if nil != err {
+		return nil, err
+	}
+
+	if _, err = w.Write(data); nil != err {
+		return nil, err
+	}
+
+	if err = w.Close(); nil != err {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+//Response writer compressing the body of genRsp() if it is large enough.
+//The status is held back until the body is written.
+type compressWriter struct {
+	http.ResponseWriter
+	svc      *ServiceMap
+	encoding string
+	status   int
+	done     bool
+}
+
+//Create compressing writer for the request
+//@param svc	Service map
+//@param w	Response writer
+//@param req	HTTP Request
+//@return writer
+func newCompressWriter(svc *ServiceMap, w http.ResponseWriter,
+	req *http.Request) *compressWriter {
+
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	return &compressWriter{ResponseWriter: w, svc: svc,
+		encoding: negotiateEncoding(req.Header.Get("Accept-Encoding"))}
+}
+
+//Underlying writer, for http.ResponseController
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+//Hold the status until body is known
+func (c *compressWriter) WriteHeader(code int) {
+	if c.done {
+		c.ResponseWriter.WriteHeader(code)
+	} else {
+		c.status = code
+	}
+}
+
+//Write the body, compressed if accepted by client and over threshold
+func (c *compressWriter) Write(b []byte) (int, error) {
+
+	if c.done {
+		return c.ResponseWriter.Write(b)
+	}
+
+	c.done = true
+	h := c.Header()
+
+	if "" != c.encoding && len(b) >= c.svc.Compress_min_size &&
+		"" == h.Get("Content-Encoding") {
+
+		if z, err := compressBody(c.encoding, b); nil == err {
+			M_ac.TpLogDebug("Response compressed with %s: %d -> %d bytes",
+				c.encoding, len(b), len(z))
+			h.Set("Content-Encoding", c.encoding)
+			h.Set("Content-Length", strconv.Itoa(len(z)))
+			c.writeStatus()
+
+			if _, err = c.ResponseWriter.Write(z); nil != err {
+				return 0, err
+			}
+
+			return len(b), nil
+		} else {
+			M_ac.TpLogError("Failed to compress response: %s", err.Error())
+		}
+	}
+
+	c.writeStatus()
+
+	return c.ResponseWriter.Write(b)
+}
+
+//Write held status (if any)
+func (c *compressWriter) writeStatus() {
+	if 0 != c.status {
+		c.ResponseWriter.WriteHeader(c.status)
+	}
+}
+
+//Complete the response if body was not written
+func (c *compressWriter) finish() {
+	if !c.done {
+		c.done = true
+		c.writeStatus()
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,212 @@
+/**
+ * @brief Cross-Origin Resource Sharing (CORS) support
+ *
+ * @file cors.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Methods allowed by default for cross-origin requests
+const CORS_METHODS_DEFAULT = "GET, HEAD, POST, PUT, PATCH, DELETE"
+
+//Compile CORS settings of the route. Origins are exact values, "*" for any
+//origin or patterns with "*" wildcard (e.g. "https://*.example.com")
+//@param ac	ATMI Context
+//@param svc	Service map
+//@return error or nil
+func initCORS(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	svc.Cors_re = nil
+
+	for _, origin := range svc.Cors_origins {
+
+		if "*" == origin && svc.Cors_credentials {
+			//Browser would send the credentials to any site
+			return fmt.Errorf("Route [%s]: CORS origin \"*\" cannot be used "+
+				"with cors_credentials", svc.Url)
+		}
+
+		if "*" == origin || !strings.Contains(origin, "*") {
+			continue
+		}
+
+		expr := "^" + strings.Replace(regexp.QuoteMeta(origin), "\\*", "[^/]*", -1) + "$"
+		re, err := regexp.Compile(expr)
+
+		if nil != err {
+			return fmt.Errorf("Route [%s]: invalid CORS origin pattern [%s]: %s",
+				svc.Url, origin, err.Error())
+		}
+
+		ac.TpLogDebug("Route [%s] CORS origin [%s] -> [%s]", svc.Url, origin, expr)
+		svc.Cors_re = append(svc.Cors_re, re)
+	}
+
+	return nil
+}
+
+//Check if origin is allowed
+//@param svc	Service map
+//@param origin	Origin header value
+//@return true if allowed, and true if any origin is allowed
+func corsOriginAllowed(svc *ServiceMap, origin string) (bool, bool) {
+
+	for _, o := range svc.Cors_origins {
+		if "*" == o {
+			return true, true
+		} else if o == origin {
+			return true, false
+		}
+	}
+
+	for _, re := range svc.Cors_re {
+		if re.MatchString(origin) {
+			return true, false
+		}
+	}
+
+	return false, false
+}
+
+//Get methods allowed for cross-origin requests
+//@param svc	Service map
+//@return comma separated methods
+func corsMethods(svc *ServiceMap) string {
+
+	if len(svc.Cors_methods) > 0 {
+		return strings.Join(svc.Cors_methods, ", ")
+	} else if "" != svc.Methods_allow {
+		return svc.Methods_allow
+	}
+
+	return CORS_METHODS_DEFAULT
+}
+
+//Process CORS of the request. Response headers are set for allowed
+//origins, preflight requests are answered without calling the service.
+//@param svc	Service map
+//@param w	Response writer
+//@param req	HTTP Request
+//@return true if request is answered (preflight)
+func handleCORS(svc *ServiceMap, w http.ResponseWriter, req *http.Request) bool {
+
+	if 0 == len(svc.Cors_origins) {
+		return false
+	}
+
+	w.Header().Add("Vary", "Origin")
+
+	origin := req.Header.Get("Origin")
+
+	if "" == origin {
+		return false
+	}
+
+	reqMethod := req.Header.Get("Access-Control-Request-Method")
+	preflight := http.MethodOptions == req.Method && "" != reqMethod
+	allowed, anyOrigin := corsOriginAllowed(svc, origin)
+
+	if !allowed {
+		M_ac.TpLogWarn("URL [%s] origin [%s] not allowed by CORS", req.URL, origin)
+
+		if preflight {
+			w.WriteHeader(http.StatusForbidden)
+			return true
+		}
+
+		return false
+	}
+
+	if anyOrigin {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if svc.Cors_credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !preflight {
+		if len(svc.Cors_expose) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers",
+				strings.Join(svc.Cors_expose, ", "))
+		}
+		return false
+	}
+
+	methods := corsMethods(svc)
+	methodOk := false
+
+	for _, m := range strings.Split(methods, ",") {
+		if strings.EqualFold(strings.TrimSpace(m), reqMethod) {
+			methodOk = true
+			break
+		}
+	}
+
+	if !methodOk {
+		M_ac.TpLogWarn("URL [%s] origin [%s]: method [%s] not allowed by CORS",
+			req.URL, origin, reqMethod)
+		w.WriteHeader(http.StatusForbidden)
+		return true
+	}
+
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+
+	if len(svc.Cors_headers) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers",
+			strings.Join(svc.Cors_headers, ", "))
+	} else if h := req.Header.Get("Access-Control-Request-Headers"); "" != h {
+		w.Header().Set("Access-Control-Allow-Headers", h)
+	}
+
+	if svc.Cors_max_age > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(svc.Cors_max_age))
+	}
+
+	M_ac.TpLogDebug("URL [%s] CORS preflight from [%s] answered", req.URL, origin)
+	w.WriteHeader(http.StatusNoContent)
+
+	return true
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
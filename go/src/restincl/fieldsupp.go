@@ -0,0 +1,140 @@
+/**
+ * @brief Installation of additional request fields (path parameters,
+ *  client certificate identity, etc.) in the XATMI buffers
+ *
+ * @file fieldsupp.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Install fields in UBF buffer. Values are loaded as field occurrences, any
+//occurrences sent by the client are removed first (no values - field is
+//removed).
+//@param ac	ATMI Context
+//@param buf	UBF buffer
+//@param fields	field name -> values
+//@return nil or UBF error
+func UBFInstallFields(ac *atmi.ATMICtx, buf *atmi.TypedUBF,
+	fields map[string][]string) atmi.UBFError {
+
+	for fld, vals := range fields {
+
+		id, err := ac.BFldId(fld)
+
+		if nil != err {
+			ac.TpLogError("Request field [%s] not found: %s",
+				fld, err.Message())
+			return err
+		}
+
+		for buf.BPres(id, 0) {
+			if err := buf.BDel(id, 0); nil != err {
+				ac.TpLogError("Failed to delete [%s]: %s", fld, err.Message())
+				return err
+			}
+		}
+
+		for occ, val := range vals {
+
+			ac.TpLogInfo("Setting field [%s] occ %d to [%s]", fld, occ, val)
+
+			if err := buf.BChg(id, occ, val); nil != err {
+				ac.TpLogError("Failed to set [%s] occ %d to [%s]: %s",
+					fld, occ, val, err.Message())
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//Install fields in VIEW buffer. Values are loaded as array elements, other
+//elements are cleared.
+//@param ac	ATMI Context
+//@param buf	VIEW buffer
+//@param fields	field (cname) -> values
+//@return nil or UBF error
+func VIEWInstallFields(ac *atmi.ATMICtx, buf *atmi.TypedVIEW,
+	fields map[string][]string) atmi.UBFError {
+
+	for fld, vals := range fields {
+
+		_, maxocc, _, _, _, err := buf.BVOccur(fld)
+
+		if nil != err {
+			ac.TpLogError("Failed to get [%s].[%s] occurrences: %s",
+				buf.BVName(), fld, err.Message())
+			return err
+		}
+
+		for occ := 0; occ < maxocc || occ < len(vals); occ++ {
+
+			val := ""
+
+			if occ < len(vals) {
+				val = vals[occ]
+			}
+
+			ac.TpLogInfo("Setting view field [%s].[%s] occ %d to [%s]",
+				buf.BVName(), fld, occ, val)
+
+			if err := buf.BVChg(fld, occ, val); nil != err {
+				ac.TpLogError("Failed to set [%s].[%s] occ %d to [%s]: %s",
+					buf.BVName(), fld, occ, val, err.Message())
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//Install fields in JSON object. Single value is set as string, multiple
+//values are set as array, key without values is removed.
+//@param obj	JSON object
+//@param fields	key -> values
+func JSONInstallFields(obj map[string]interface{}, fields map[string][]string) {
+
+	for key, vals := range fields {
+		if 0 == len(vals) {
+			delete(obj, key)
+		} else if 1 == len(vals) {
+			obj[key] = vals[0]
+		} else {
+			obj[key] = vals
+		}
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,188 @@
+/**
+ * @brief Query string & form body (urlencoded/multipart) mapping to UBF
+ *
+ * @file formsupp.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+const (
+	FORM_MAXMEM_DEFAULT = 32 << 20 //Multipart in memory size, rest goes to tmp
+)
+
+//Parse the query string and form body of the request (if enabled for route)
+//Must be called before request body is read.
+//@param ac	ATMI Context
+//@param svc	Service map
+//@param req	HTTP Request
+//@return nil or ATMI error (TPEINVAL)
+func parseFormParams(ac *atmi.ATMICtx, svc *ServiceMap, req *http.Request) atmi.ATMIError {
+
+	var err error
+
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		err = req.ParseMultipartForm(FORM_MAXMEM_DEFAULT)
+	} else {
+		err = req.ParseForm()
+	}
+
+	if nil != err {
+		ac.TpLogError("Failed to parse form/query: %s", err.Error())
+
+		if bodyLimitExceeded(req) {
+			return errBodyTooLarge()
+		}
+
+		return atmi.NewCustomATMIError(atmi.TPEINVAL,
+			"Failed to parse form/query: "+err.Error())
+	}
+
+	return nil
+}
+
+//Resolve UBF field for the form parameter name. Explicit mapping is checked
+//first, then prefix + parameter name is used.
+//@param ac	ATMI Context
+//@param svc	Service map
+//@param name	Parameter name
+//@return field id or atmi.BBADFLDID if not found
+func formFieldId(ac *atmi.ATMICtx, svc *ServiceMap, name string) int {
+
+	fldName, ok := svc.Form_fields[name]
+
+	if !ok {
+		fldName = svc.Form_prefix + name
+	}
+
+	id, err := ac.BFldId(fldName)
+
+	if nil != err {
+		ac.TpLogWarn("Form parameter [%s] field [%s] not found - ignore: %s",
+			name, fldName, err.Message())
+		return atmi.BBADFLDID
+	}
+
+	return id
+}
+
+//Install query string & form fields in UBF buffer. Repeated parameters are
+//loaded as field occurrences. Multipart files are loaded as binary data.
+//@param ac	ATMI Context
+//@param svc	Service map
+//@param req	HTTP Request (parsed by parseFormParams())
+//@param buf	UBF buffer
+//@return nil or ATMI error
+func UBFInstallFormParams(ac *atmi.ATMICtx, svc *ServiceMap, req *http.Request,
+	buf *atmi.TypedUBF) atmi.ATMIError {
+
+	//Process in sorted order, so that buffers are stable
+	names := []string{}
+
+	for name := range req.Form {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+
+		id := formFieldId(ac, svc, name)
+
+		if atmi.BBADFLDID == id {
+			continue
+		}
+
+		for _, val := range req.Form[name] {
+			ac.TpLogDebug("Form parameter [%s] value [%s]", name, val)
+
+			if err := buf.BAdd(id, val); nil != err {
+				ac.TpLogError("Failed to add form parameter [%s]: %s",
+					name, err.Message())
+				return err
+			}
+		}
+	}
+
+	if nil == req.MultipartForm {
+		return nil
+	}
+
+	for name, files := range req.MultipartForm.File {
+
+		id := formFieldId(ac, svc, name)
+
+		if atmi.BBADFLDID == id {
+			continue
+		}
+
+		for _, fh := range files {
+
+			f, err := fh.Open()
+
+			if nil != err {
+				ac.TpLogError("Failed to open multipart file [%s]: %s",
+					fh.Filename, err.Error())
+				return atmi.NewCustomATMIError(atmi.TPEINVAL,
+					"Failed to open multipart file: "+err.Error())
+			}
+
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+
+			if nil != err {
+				ac.TpLogError("Failed to read multipart file [%s]: %s",
+					fh.Filename, err.Error())
+				return atmi.NewCustomATMIError(atmi.TPEINVAL,
+					"Failed to read multipart file: "+err.Error())
+			}
+
+			ac.TpLogDebug("Form file [%s] name [%s] size %d",
+				name, fh.Filename, len(data))
+
+			if errU := buf.BAdd(id, data); nil != errU {
+				ac.TpLogError("Failed to add form file [%s]: %s",
+					name, errU.Message())
+				return errU
+			}
+		}
+	}
+
+	return nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
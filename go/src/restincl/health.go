@@ -0,0 +1,143 @@
+/**
+ * @brief Health (liveness) and readiness endpoints
+ *
+ * @file health.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+var M_healthz_url string  //Liveness URL on main listener (not served if empty)
+var M_readyz_url string   //Readiness URL on main listener (not served if empty)
+var M_ready_svcs []string //Services which must respond for readiness
+var M_config_loaded bool  //Configuration loaded and pool initialized
+var M_draining int32      //Set to 1 when shutdown drain is started
+
+//Parse list of readiness services
+//@param list	comma or space separated service names
+func parseReadySvcs(list string) {
+
+	M_ready_svcs = strings.FieldsFunc(list, func(r rune) bool {
+		return ',' == r || ' ' == r || '\t' == r
+	})
+}
+
+//Check the readiness
+//@return empty string if ready, otherwise the reason
+func checkReady() string {
+
+	if !M_config_loaded {
+		return "configuration not loaded"
+	}
+
+	if 1 == atomic.LoadInt32(&M_draining) {
+		return "shutting down"
+	}
+
+	var nr int
+
+	select {
+	case nr = <-M_freechan:
+	default:
+		return "no free XATMI session"
+	}
+
+	defer func() { M_freechan <- nr }()
+
+	ac := M_ctxs[nr]
+
+	for _, svc := range M_ready_svcs {
+
+		buf, err := ac.NewUBF(1024)
+
+		if nil != err {
+			return fmt.Sprintf("failed to allocate buffer: %s", err.Message())
+		}
+
+		if _, err := ac.TpCall(svc, buf, 0); nil != err {
+			ac.TpLogWarn("Readiness service [%s] failed: %d:[%s]",
+				svc, err.Code(), err.Message())
+			return fmt.Sprintf("service [%s] failed: %s", svc, err.Message())
+		}
+	}
+
+	return ""
+}
+
+//Liveness handler: process is serving
+//@param w	Response writer
+//@param req	HTTP Request
+func healthzHandler(w http.ResponseWriter, req *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK\n"))
+}
+
+//Readiness handler: 200 if ready to serve, otherwise 503
+//@param w	Response writer
+//@param req	HTTP Request
+func readyzHandler(w http.ResponseWriter, req *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	if reason := checkReady(); "" != reason {
+		M_ac.TpLogWarn("Not ready: %s", reason)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("NOT READY: " + reason + "\n"))
+		return
+	}
+
+	w.Write([]byte("READY\n"))
+}
+
+//Register health endpoints on main listener (if configured)
+//@param ac	ATMI Context
+func initHealth(ac *atmi.ATMICtx) {
+
+	if "" != M_healthz_url {
+		ac.TpLogInfo("Liveness endpoint: [%s]", M_healthz_url)
+		M_handler.HandleBuiltin(M_healthz_url, http.HandlerFunc(healthzHandler))
+	}
+
+	if "" != M_readyz_url {
+		ac.TpLogInfo("Readiness endpoint: [%s], services: %v",
+			M_readyz_url, M_ready_svcs)
+		M_handler.HandleBuiltin(M_readyz_url, http.HandlerFunc(readyzHandler))
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
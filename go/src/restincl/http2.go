@@ -0,0 +1,140 @@
+/**
+ * @brief HTTP/2 (TLS) and h2c (cleartext HTTP/2) settings of the listeners
+ *
+ * @file http2.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+//HTTP/2 defaults
+const (
+	HTTP2_MAX_STREAMS_DEFAULT  = 250 //Same as Golang default
+	HTTP2_PING_TIMEOUT_DEFAULT = 15  //Seconds
+)
+
+var M_http2 int16 = TRUE      //HTTP/2 on TLS listeners
+var M_h2c int16 = FALSE       //Cleartext HTTP/2 on non-TLS listeners
+var M_http2_max_streams int   //Max concurrent streams per connection
+var M_http2_ping_interval int //Idle seconds before health check ping
+var M_http2_ping_timeout int  //Seconds to wait for ping response
+var M_keepalive int16 = TRUE  //HTTP/1.1 keep-alive connections
+
+//Check that the cipher suites allow HTTP/2 (RFC 7540 9.2.2). TLS 1.3
+//suites are not configurable, thus any list is fine if 1.2 is not accepted.
+//@param cfg	TLS config
+//@return true if HTTP/2 can be used
+func http2Ciphers(cfg *tls.Config) bool {
+
+	if nil == cfg || 0 == len(cfg.CipherSuites) || cfg.MinVersion >= tls.VersionTLS13 {
+		return true
+	}
+
+	for _, id := range cfg.CipherSuites {
+		if tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 == id ||
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Disable HTTP/2 on TLS server
+//@param server	HTTP server
+func disableHTTP2(server *http.Server) {
+
+	//Non nil map disables HTTP/2
+	server.TLSNextProto = make(map[string]func(*http.Server,
+		*tls.Conn, http.Handler))
+}
+
+//Configure HTTP/2 and keep-alive of the listener's server. Must be called
+//after the TLS config is set.
+//@param ac	ATMI Context
+//@param l	listener
+//@return error or nil
+func configureHTTP2(ac *atmi.ATMICtx, l *listener) error {
+
+	l.server.SetKeepAlivesEnabled(TRUE == M_keepalive)
+
+	if l.Tls_enable && TRUE == M_http2 && !http2Ciphers(l.server.TLSConfig) {
+		ac.TpLogWarn("Listener [%s]: tls_ciphers lack %s or %s required by "+
+			"HTTP/2 - HTTP/2 disabled", l.Name,
+			tls.CipherSuiteName(tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256),
+			tls.CipherSuiteName(tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256))
+		disableHTTP2(l.server)
+		return nil
+	}
+
+	if l.Tls_enable && TRUE != M_http2 {
+		disableHTTP2(l.server)
+		ac.TpLogInfo("Listener [%s]: HTTP/2 disabled", l.Name)
+		return nil
+	}
+
+	if !l.Tls_enable && TRUE != M_h2c {
+		return nil
+	}
+
+	h2s := &http2.Server{
+		MaxConcurrentStreams: uint32(M_http2_max_streams),
+		IdleTimeout:          time.Duration(M_idle_timeout) * time.Second,
+		ReadIdleTimeout:      time.Duration(M_http2_ping_interval) * time.Second,
+		PingTimeout:          time.Duration(M_http2_ping_timeout) * time.Second,
+	}
+
+	//Also registers graceful shutdown of HTTP/2 connections
+	if err := http2.ConfigureServer(l.server, h2s); nil != err {
+		ac.TpLogError("Listener [%s]: failed to configure HTTP/2: %s",
+			l.Name, err.Error())
+		return err
+	}
+
+	if !l.Tls_enable {
+		l.server.Handler = h2c.NewHandler(l.server.Handler, h2s)
+	}
+
+	ac.TpLogInfo("Listener [%s]: HTTP/2 enabled (h2c: %t), max streams %d, "+
+		"ping interval %d sec, ping timeout %d sec", l.Name, !l.Tls_enable,
+		M_http2_max_streams, M_http2_ping_interval, M_http2_ping_timeout)
+
+	return nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,267 @@
+/**
+ * @brief Additional HTTP listeners with own routes, authentication and TLS
+ *
+ * @file listener.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Listener settings
+const (
+	LISTENER_PREFIX = "listener_" //Ini key prefix, followed by name
+	LISTENER_MAIN   = "main"      //Listener of ip/port settings
+)
+
+//HTTP listener. Additional listeners serve all routes or the listed subset
+//and may require authentication for all requests. The same applies to the
+//listener of ip/port settings if configured by listener_main.
+type listener struct {
+	tlsSettings
+	Name   string   `json:"-"`
+	Ip     string   `json:"ip"`
+	Port   int      `json:"port"`
+	Routes []string `json:"routes"` //Route URLs served, all if empty
+
+	cfg     string     //JSON config
+	auth    ServiceMap //Authentication and error format settings
+	handler http.Handler
+	server  *http.Server
+}
+
+var M_listeners []*listener   //Additional listeners, in config order
+var M_listener_main *listener //Routes and auth of ip/port listener, if set
+
+//Add listener from the listener_<name> key. Settings are resolved when
+//all routes are loaded (see initListeners()).
+//@param ac	ATMI Context
+//@param key	ini key
+//@param cfg	JSON config
+//@return error or nil
+func addListener(ac *atmi.ATMICtx, key string, cfg string) error {
+
+	name := strings.TrimPrefix(key, LISTENER_PREFIX)
+
+	if "" == name {
+		return fmt.Errorf("Invalid listener name in [%s]", key)
+	}
+
+	ac.TpLogInfo("Got listener [%s] config [%s]", name, cfg)
+
+	if LISTENER_MAIN == name {
+		M_listener_main = &listener{Name: name, cfg: cfg}
+		return nil
+	}
+
+	M_listeners = append(M_listeners, &listener{Name: name, cfg: cfg})
+
+	return nil
+}
+
+//Parse the listener settings, resolve authentication and build its
+//route handler
+//@param ac	ATMI Context
+//@param l	listener
+//@return error or nil
+func (l *listener) init(ac *atmi.ATMICtx) error {
+
+	if err := json.NewDecoder(strings.NewReader(l.cfg)).Decode(l); nil != err {
+		return fmt.Errorf("Failed to parse listener [%s]: %s", l.Name, err)
+	}
+
+	if LISTENER_MAIN == l.Name {
+		//Address and TLS come from the global settings
+		if 0 != l.Port || "" != l.Ip || l.Tls_enable {
+			return fmt.Errorf("Listener [%s]: ip, port and TLS are set by "+
+				"global settings", l.Name)
+		}
+	} else if l.Port <= 0 || "" == l.Ip {
+		return fmt.Errorf("Listener [%s]: missing ip (%s) or port (%d)",
+			l.Name, l.Ip, l.Port)
+	}
+
+	if l.Tls_enable && ("" == l.Tls_cert_file || "" == l.Tls_key_file) {
+		return fmt.Errorf("Listener [%s]: missing tls_cert_file or tls_key_file",
+			l.Name)
+	}
+
+	//Authentication and error format keys are the same as for routes
+	l.auth = copyServiceMap(&M_defaults)
+
+	if err := json.NewDecoder(strings.NewReader(l.cfg)).Decode(&l.auth); nil != err {
+		return fmt.Errorf("Failed to parse listener [%s]: %s", l.Name, err)
+	}
+
+	l.auth.Url = LISTENER_PREFIX + l.Name
+	remapErrors(&l.auth)
+
+	if err := initAuth(ac, &l.auth); nil != err {
+		return err
+	}
+
+	h := &RegexpHandler{urlMap: make(map[string]ServiceMap),
+		defaultHandler: make(map[string]http.Handler),
+		builtinHandler: M_handler.builtinHandler}
+
+	if nil != l.auth.Auth_prov {
+		h.auth = &l.auth
+	}
+
+	served := make(map[string]bool)
+
+	for _, url := range l.Routes {
+		served[url] = false
+	}
+
+	for _, svc := range M_handler.routes {
+
+		if _, ok := served[svc.Url]; ok || 0 == len(l.Routes) {
+			//Checked in dispatchRequest(), so that rejections are logged
+			//and measured as the route's requests
+			svc.Listener_auth = h.auth
+			h.HandleFunc(svc.Path_re, svc)
+			served[svc.Url] = true
+		}
+	}
+
+	for url, ok := range served {
+		if !ok {
+			return fmt.Errorf("Listener [%s]: route [%s] not found", l.Name, url)
+		}
+	}
+
+	ac.TpLogInfo("Listener [%s] on %s:%d, TLS: %t, routes: %d, auth: [%s]",
+		l.Name, l.Ip, l.Port, l.Tls_enable, len(h.routes), l.auth.Auth)
+
+	l.handler = h
+
+	return nil
+}
+
+//Resolve additional listeners
+//@param ac	ATMI Context
+//@return error or nil
+func initListeners(ac *atmi.ATMICtx) error {
+
+	if nil != M_listener_main {
+		if err := M_listener_main.init(ac); nil != err {
+			return err
+		}
+	}
+
+	for _, l := range M_listeners {
+		if err := l.init(ac); nil != err {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Create HTTP server of the listener
+//@param ac	ATMI Context
+//@return error or nil
+func (l *listener) newServer(ac *atmi.ATMICtx) error {
+
+	var err error
+
+	listenOn := fmt.Sprintf("%s:%d", l.Ip, l.Port)
+	ac.TpLog(atmi.LOG_INFO, "About to listen [%s] on: (ip: %s, port: %d) %s",
+		l.Name, l.Ip, l.Port, listenOn)
+
+	l.server = &http.Server{Addr: listenOn, Handler: l.handler}
+	applyServerLimits(ac, l.server)
+	//Hijacked and long running connections are not drained by Shutdown()
+	l.server.RegisterOnShutdown(stopStreams)
+
+	if l.Tls_enable {
+		if l.server.TLSConfig, err = getTLSConfig(ac, &l.tlsSettings); nil != err {
+			ac.TpLogError("Listener [%s]: invalid TLS settings: %s", l.Name,
+				err.Error())
+			return err
+		}
+	}
+
+	return configureHTTP2(ac, l)
+}
+
+//Serve the listener until it fails or is shut down
+//@return error (http.ErrServerClosed on shutdown)
+func (l *listener) serve() error {
+
+	if l.Tls_enable {
+		return l.server.ListenAndServeTLS(l.Tls_cert_file, l.Tls_key_file)
+	}
+
+	return l.server.ListenAndServe()
+}
+
+//Shutdown the additional listeners, in-flight requests are completed
+//@param ctx	drain time-out context
+//@return error or nil
+func shutdownListeners(ctx context.Context) error {
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(M_listeners))
+
+	for _, l := range M_listeners {
+		if nil == l.server {
+			continue
+		}
+
+		wg.Add(1)
+		go func(l *listener) {
+			defer wg.Done()
+			errs <- l.server.Shutdown(ctx)
+		}(l)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if nil != err {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
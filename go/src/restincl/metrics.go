@@ -0,0 +1,354 @@
+/**
+ * @brief Prometheus text format metrics
+ *
+ * @file metrics.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Request latency histogram buckets, seconds
+var M_latency_buckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5,
+	1, 2.5, 5, 10, 30}
+
+//ATMI error names for metric labels
+var M_atmi_errors = map[int]string{
+	atmi.TPEABORT:     "TPEABORT",
+	atmi.TPEBADDESC:   "TPEBADDESC",
+	atmi.TPEBLOCK:     "TPEBLOCK",
+	atmi.TPEINVAL:     "TPEINVAL",
+	atmi.TPELIMIT:     "TPELIMIT",
+	atmi.TPENOENT:     "TPENOENT",
+	atmi.TPEOS:        "TPEOS",
+	atmi.TPEPERM:      "TPEPERM",
+	atmi.TPEPROTO:     "TPEPROTO",
+	atmi.TPESVCERR:    "TPESVCERR",
+	atmi.TPESVCFAIL:   "TPESVCFAIL",
+	atmi.TPESYSTEM:    "TPESYSTEM",
+	atmi.TPETIME:      "TPETIME",
+	atmi.TPETRAN:      "TPETRAN",
+	atmi.TPGOTSIG:     "TPGOTSIG",
+	atmi.TPERMERR:     "TPERMERR",
+	atmi.TPEITYPE:     "TPEITYPE",
+	atmi.TPEOTYPE:     "TPEOTYPE",
+	atmi.TPERELEASE:   "TPERELEASE",
+	atmi.TPEHAZARD:    "TPEHAZARD",
+	atmi.TPEHEURISTIC: "TPEHEURISTIC",
+	atmi.TPEEVENT:     "TPEEVENT",
+	atmi.TPEMATCH:     "TPEMATCH",
+}
+
+//Per route statistics
+type routeMetrics struct {
+	requests   map[string]uint64 //method + status -> count
+	atmiErrors map[string]uint64 //ATMI error -> count
+	buckets    []uint64          //Latency histogram (not cumulative)
+	sum        float64           //Latency sum, seconds
+	count      uint64            //Number of latency observations
+}
+
+//Metrics registry
+type metricsRegistry struct {
+	mu     sync.Mutex
+	routes map[string]*routeMetrics
+}
+
+var M_metrics = metricsRegistry{routes: make(map[string]*routeMetrics)}
+var M_metrics_enable bool //Collect metrics (admin listener configured)
+var M_inflight int64      //Requests in processing
+
+//Response writer recording the HTTP status
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64 //Body bytes written
+}
+
+//Record status
+func (s *statusWriter) WriteHeader(code int) {
+	if 0 == s.status {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+//Write body, implicit 200 status
+func (s *statusWriter) Write(b []byte) (int, error) {
+	if 0 == s.status {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+//Pass flush to underlying writer (streaming responses)
+func (s *statusWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//Underlying writer, for http.ResponseController
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+//Pass hijack to underlying writer (connection upgrades)
+func (s *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := s.ResponseWriter.(http.Hijacker); ok {
+		s.status = http.StatusSwitchingProtocols
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("Connection hijack not supported")
+}
+
+//Get route statistics, registry must be locked
+//@param url	route
+//@return route statistics
+func (m *metricsRegistry) route(url string) *routeMetrics {
+
+	r, ok := m.routes[url]
+
+	if !ok {
+		r = &routeMetrics{requests: make(map[string]uint64),
+			atmiErrors: make(map[string]uint64),
+			buckets:    make([]uint64, len(M_latency_buckets))}
+		m.routes[url] = r
+	}
+
+	return r
+}
+
+//Start request measurement
+//@param url	route
+//@param w	Response writer
+//@param req	HTTP Request
+//@return Response writer to use and function to call when request is done
+func metricsStart(url string, w http.ResponseWriter,
+	req *http.Request) (http.ResponseWriter, func()) {
+
+	if !M_metrics_enable {
+		return w, func() {}
+	}
+
+	sw := &statusWriter{ResponseWriter: w}
+	start := time.Now()
+	atomic.AddInt64(&M_inflight, 1)
+
+	return sw, func() {
+
+		atomic.AddInt64(&M_inflight, -1)
+		elapsed := time.Since(start).Seconds()
+		status := sw.status
+
+		if 0 == status {
+			status = http.StatusOK
+		}
+
+		M_metrics.mu.Lock()
+		defer M_metrics.mu.Unlock()
+
+		r := M_metrics.route(url)
+		r.requests[req.Method+"|"+strconv.Itoa(status)]++
+		r.sum += elapsed
+		r.count++
+
+		for i, le := range M_latency_buckets {
+			if elapsed <= le {
+				r.buckets[i]++
+				break
+			}
+		}
+	}
+}
+
+//Count ATMI error of the route
+//@param svc	Service map
+//@param code	ATMI error code
+func metricsATMIError(svc *ServiceMap, code int) {
+
+	if !M_metrics_enable {
+		return
+	}
+
+	name, ok := M_atmi_errors[code]
+
+	if !ok {
+		name = strconv.Itoa(code)
+	}
+
+	M_metrics.mu.Lock()
+	M_metrics.route(svc.Url).atmiErrors[name]++
+	M_metrics.mu.Unlock()
+}
+
+//Escape label value
+//@param v	value
+//@return escaped value
+func metricsLabel(v string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(v)
+}
+
+//Get sorted map keys
+//@param m	map
+//@return keys
+func sortedKeys(m map[string]uint64) []string {
+
+	keys := make([]string, 0, len(m))
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+//Serve metrics in Prometheus text format
+//@param w	Response writer
+//@param req	HTTP Request
+func metricsHandler(w http.ResponseWriter, req *http.Request) {
+
+	var b strings.Builder
+
+	M_metrics.mu.Lock()
+
+	routes := make([]string, 0, len(M_metrics.routes))
+
+	for url := range M_metrics.routes {
+		routes = append(routes, url)
+	}
+
+	sort.Strings(routes)
+
+	b.WriteString("# HELP restincl_requests_total HTTP requests by route, method and status.\n")
+	b.WriteString("# TYPE restincl_requests_total counter\n")
+
+	for _, url := range routes {
+		r := M_metrics.routes[url]
+		for _, k := range sortedKeys(r.requests) {
+			pair := strings.SplitN(k, "|", 2)
+			fmt.Fprintf(&b, "restincl_requests_total{route=\"%s\",method=\"%s\",code=\"%s\"} %d\n",
+				metricsLabel(url), metricsLabel(pair[0]), pair[1], r.requests[k])
+		}
+	}
+
+	b.WriteString("# HELP restincl_atmi_errors_total ATMI errors by route.\n")
+	b.WriteString("# TYPE restincl_atmi_errors_total counter\n")
+
+	for _, url := range routes {
+		r := M_metrics.routes[url]
+		for _, k := range sortedKeys(r.atmiErrors) {
+			fmt.Fprintf(&b, "restincl_atmi_errors_total{route=\"%s\",error=\"%s\"} %d\n",
+				metricsLabel(url), k, r.atmiErrors[k])
+		}
+	}
+
+	b.WriteString("# HELP restincl_request_duration_seconds Request processing time by route.\n")
+	b.WriteString("# TYPE restincl_request_duration_seconds histogram\n")
+
+	for _, url := range routes {
+		r := M_metrics.routes[url]
+		label := metricsLabel(url)
+		var cumulative uint64
+
+		for i, le := range M_latency_buckets {
+			cumulative += r.buckets[i]
+			fmt.Fprintf(&b, "restincl_request_duration_seconds_bucket{route=\"%s\",le=\"%s\"} %d\n",
+				label, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+
+		fmt.Fprintf(&b, "restincl_request_duration_seconds_bucket{route=\"%s\",le=\"+Inf\"} %d\n",
+			label, r.count)
+		fmt.Fprintf(&b, "restincl_request_duration_seconds_sum{route=\"%s\"} %g\n",
+			label, r.sum)
+		fmt.Fprintf(&b, "restincl_request_duration_seconds_count{route=\"%s\"} %d\n",
+			label, r.count)
+	}
+
+	M_metrics.mu.Unlock()
+
+	b.WriteString("# HELP restincl_ratelimit_rejected_total Requests rejected by rate limits.\n")
+	b.WriteString("# TYPE restincl_ratelimit_rejected_total counter\n")
+
+	M_rate_limiters_mu.Lock()
+
+	for _, l := range M_rate_limiters {
+
+		label := metricsLabel(l.url)
+
+		if "" != l.method {
+			label += "\",method=\"" + metricsLabel(l.method)
+		}
+
+		fmt.Fprintf(&b, "restincl_ratelimit_rejected_total{route=\"%s\",scope=\"route\"} %d\n",
+			label, atomic.LoadUint64(&l.rejectedRoute))
+		fmt.Fprintf(&b, "restincl_ratelimit_rejected_total{route=\"%s\",scope=\"client\"} %d\n",
+			label, atomic.LoadUint64(&l.rejectedClient))
+	}
+
+	M_rate_limiters_mu.Unlock()
+
+	fmt.Fprintf(&b, "# HELP restincl_workers Number of XATMI sessions.\n"+
+		"# TYPE restincl_workers gauge\nrestincl_workers %d\n", M_workers)
+	fmt.Fprintf(&b, "# HELP restincl_workers_busy XATMI sessions in use.\n"+
+		"# TYPE restincl_workers_busy gauge\nrestincl_workers_busy %d\n",
+		M_workers-len(M_freechan))
+	fmt.Fprintf(&b, "# HELP restincl_inflight_requests Requests in processing.\n"+
+		"# TYPE restincl_inflight_requests gauge\nrestincl_inflight_requests %d\n",
+		atomic.LoadInt64(&M_inflight))
+	fmt.Fprintf(&b, "# HELP restincl_queue_waiting Requests waiting for XATMI session.\n"+
+		"# TYPE restincl_queue_waiting gauge\nrestincl_queue_waiting %d\n",
+		atomic.LoadInt32(&M_queue_len))
+	fmt.Fprintf(&b, "# HELP restincl_queue_rejected_total Requests rejected by queue limits.\n"+
+		"# TYPE restincl_queue_rejected_total counter\nrestincl_queue_rejected_total %d\n",
+		atomic.LoadUint64(&M_queue_rejected))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
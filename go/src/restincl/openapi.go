@@ -0,0 +1,756 @@
+/**
+ * @brief OpenAPI 3 document generation from routes, UBF field tables and VIEWs
+ *
+ * @file openapi.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Defaults
+const (
+	OPENAPI_TITLE_DEFAULT   = "Enduro/X REST API"
+	OPENAPI_VERSION_DEFAULT = "1.0.0"
+)
+
+var M_openapi_url string     //OpenAPI document URL on main listener
+var M_openapi_title string   //Document title
+var M_openapi_version string //API version
+var M_openapi_cli bool       //Print document to stdout and exit
+var M_openapi_doc []byte     //Generated document
+
+//Key of the error fields in errfmt_json_code/errfmt_json_msg, e.g. "error_code":%d
+var M_errfmtKey = regexp.MustCompile(`^\s*"([^"]+)"\s*:`)
+
+//Characters not allowed in operationId
+var M_opIdStrip = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+//UBF field from field table
+type ubfFieldDef struct {
+	name  string
+	ftype string
+}
+
+//VIEW field from view file
+type viewFieldDef struct {
+	ftype string
+	cname string
+	count int
+	size  int
+}
+
+//Document generator state
+type openAPIGen struct {
+	ac        *atmi.ATMICtx
+	fields    []ubfFieldDef             //All UBF fields, in table order
+	fieldMap  map[string]string         //UBF field -> type
+	views     map[string][]viewFieldDef //VIEW -> fields
+	viewNames []string                  //All views, in file order
+	schemas   map[string]interface{}    //components/schemas
+	security  map[string]interface{}    //components/securitySchemes
+}
+
+//Find file in the list of directories
+//@param dirs	directories separated by ':'
+//@param file	file name
+//@return full path or "" if not found
+func findInDirs(dirs string, file string) string {
+
+	for _, dir := range strings.Split(dirs, ":") {
+
+		if "" == dir {
+			continue
+		}
+
+		path := filepath.Join(dir, file)
+
+		if _, err := os.Stat(path); nil == err {
+			return path
+		}
+	}
+
+	return ""
+}
+
+//Read non empty lines of the files, listed in environment variable and
+//found in the directories of other environment variable
+//@param ac	ATMI Context
+//@param dirsEnv	directories variable (e.g. FLDTBLDIR)
+//@param filesEnv	files variable (e.g. FIELDTBLS)
+//@param fn	callback for each line
+//@return error or nil
+func readDefFiles(ac *atmi.ATMICtx, dirsEnv string, filesEnv string,
+	fn func(line string) error) error {
+
+	dirs := os.Getenv(dirsEnv)
+
+	for _, file := range strings.Split(os.Getenv(filesEnv), ",") {
+
+		if file = strings.TrimSpace(file); "" == file {
+			continue
+		}
+
+		path := findInDirs(dirs, file)
+
+		if "" == path {
+			return fmt.Errorf("File [%s] (%s) not found in %s [%s]",
+				file, filesEnv, dirsEnv, dirs)
+		}
+
+		ac.TpLogInfo("Loading definitions from [%s]", path)
+
+		f, err := os.Open(path)
+
+		if nil != err {
+			return err
+		}
+
+		scanner := bufio.NewScanner(f)
+
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+
+			if "" == line || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			if err := fn(line); nil != err {
+				f.Close()
+				return fmt.Errorf("%s: %s", path, err.Error())
+			}
+		}
+
+		err = scanner.Err()
+		f.Close()
+
+		if nil != err {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Load UBF field tables (FLDTBLDIR/FIELDTBLS)
+//@return error or nil
+func (g *openAPIGen) loadFieldTables() error {
+
+	g.fieldMap = make(map[string]string)
+
+	return readDefFiles(g.ac, "FLDTBLDIR", "FIELDTBLS", func(line string) error {
+
+		//C header lines and directives (*base)
+		if strings.HasPrefix(line, "$") || strings.HasPrefix(line, "*") {
+			return nil
+		}
+
+		f := strings.Fields(line)
+
+		if len(f) < 3 {
+			return fmt.Errorf("Invalid field definition [%s]", line)
+		}
+
+		if _, exists := g.fieldMap[f[0]]; !exists {
+			g.fields = append(g.fields, ubfFieldDef{name: f[0], ftype: f[2]})
+			g.fieldMap[f[0]] = f[2]
+		}
+
+		return nil
+	})
+}
+
+//Load VIEW definitions (VIEWDIR/VIEWFILES)
+//@return error or nil
+func (g *openAPIGen) loadViews() error {
+
+	g.views = make(map[string][]viewFieldDef)
+	view := ""
+
+	return readDefFiles(g.ac, "VIEWDIR", "VIEWFILES", func(line string) error {
+
+		f := strings.Fields(line)
+
+		switch {
+		case "VIEW" == f[0] && len(f) > 1:
+			view = f[1]
+			g.views[view] = []viewFieldDef{}
+			g.viewNames = append(g.viewNames, view)
+		case "END" == f[0]:
+			view = ""
+		case "" == view:
+			return fmt.Errorf("Field outside of VIEW [%s]", line)
+		case len(f) < 6:
+			return fmt.Errorf("Invalid VIEW [%s] field [%s]", view, line)
+		default:
+			count, err := strconv.Atoi(f[3])
+
+			if nil != err {
+				return fmt.Errorf("Invalid count in VIEW [%s] field [%s]", view, line)
+			}
+
+			size, _ := strconv.Atoi(f[5])
+			g.views[view] = append(g.views[view], viewFieldDef{ftype: f[0],
+				cname: f[1], count: count, size: size})
+		}
+
+		return nil
+	})
+}
+
+//Schema of UBF/VIEW field type
+//@param ftype	field type
+//@param size	string/carray size (VIEW), 0 if not limited
+//@return schema or nil if type cannot be represented in JSON
+func typeSchema(ftype string, size int) map[string]interface{} {
+
+	switch ftype {
+	case "short", "int":
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case "long":
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case "char":
+		return map[string]interface{}{"type": "string", "maxLength": 1}
+	case "float":
+		return map[string]interface{}{"type": "number", "format": "float"}
+	case "double":
+		return map[string]interface{}{"type": "number", "format": "double"}
+	case "string":
+		s := map[string]interface{}{"type": "string"}
+
+		//Size includes EOS
+		if size > 1 {
+			s["maxLength"] = size - 1
+		}
+
+		return s
+	case "carray":
+		return map[string]interface{}{"type": "string", "format": "byte"}
+	case "ubf", "view":
+		return map[string]interface{}{"type": "object"}
+	}
+
+	return nil
+}
+
+//Schema of UBF field, value or array of occurrences
+//@param ftype	field type
+//@return schema or nil
+func ubfFieldSchema(ftype string) map[string]interface{} {
+
+	s := typeSchema(ftype, 0)
+
+	if nil == s {
+		return nil
+	}
+
+	return map[string]interface{}{"oneOf": []interface{}{s,
+		map[string]interface{}{"type": "array", "items": s}}}
+}
+
+//Schema of UBF buffer. If field list is empty, all fields from field
+//tables are included (as "UBF" component).
+//@param fields	UBF fields
+//@return schema
+func (g *openAPIGen) ubfSchema(fields []string) map[string]interface{} {
+
+	if 0 == len(fields) {
+
+		if _, ok := g.schemas["UBF"]; !ok {
+			props := make(map[string]interface{})
+
+			for _, f := range g.fields {
+				if s := ubfFieldSchema(f.ftype); nil != s {
+					props[f.name] = s
+				}
+			}
+
+			g.schemas["UBF"] = map[string]interface{}{"type": "object",
+				"properties": props}
+		}
+
+		return map[string]interface{}{"$ref": "#/components/schemas/UBF"}
+	}
+
+	props := make(map[string]interface{})
+
+	for _, name := range fields {
+
+		ftype, ok := g.fieldMap[name]
+
+		if !ok {
+			g.ac.TpLogWarn("OpenAPI: field [%s] not found in field tables", name)
+			continue
+		}
+
+		if s := ubfFieldSchema(ftype); nil != s {
+			props[name] = s
+		}
+	}
+
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+//Schema of VIEW buffer in JSON, i.e. {"<VIEW>":{<fields>}}. If view list
+//is empty, all views are included.
+//@param views	VIEW names
+//@return schema
+func (g *openAPIGen) viewSchema(views []string) map[string]interface{} {
+
+	if 0 == len(views) {
+		views = g.viewNames
+	}
+
+	var variants []interface{}
+
+	for _, view := range views {
+
+		fields, ok := g.views[view]
+
+		if !ok {
+			g.ac.TpLogWarn("OpenAPI: VIEW [%s] not found in view files", view)
+			continue
+		}
+
+		if _, ok := g.schemas[view]; !ok {
+			props := make(map[string]interface{})
+
+			for _, f := range fields {
+				s := typeSchema(f.ftype, f.size)
+
+				if nil == s {
+					continue
+				}
+
+				if f.count > 1 {
+					s = map[string]interface{}{"type": "array", "items": s,
+						"maxItems": f.count}
+				}
+
+				props[f.cname] = s
+			}
+
+			g.schemas[view] = map[string]interface{}{"type": "object",
+				"properties": props}
+		}
+
+		variants = append(variants, map[string]interface{}{
+			"type":       "object",
+			"required":   []string{view},
+			"properties": map[string]interface{}{view: map[string]interface{}{"$ref": "#/components/schemas/" + view}},
+		})
+	}
+
+	if 1 == len(variants) {
+		return variants[0].(map[string]interface{})
+	}
+
+	return map[string]interface{}{"oneOf": variants}
+}
+
+//Request and response body content of the route
+//@param svc	Service map
+//@param fields	UBF fields or VIEWs of the body
+//@param rsp	true if response body
+//@return content
+func (g *openAPIGen) content(svc *ServiceMap, fields []string,
+	rsp bool) map[string]interface{} {
+
+	var ctype string
+	var schema map[string]interface{}
+
+	switch svc.Conv_int {
+	case CONV_JSON2UBF, CONV_XML2UBF:
+		if rsp && isUBFErrors(svc) && len(fields) > 0 {
+			fields = append(append([]string{}, fields...),
+				"EX_IF_ECODE", "EX_IF_EMSG")
+		}
+
+		schema = g.ubfSchema(fields)
+		ctype = "application/json"
+
+		if CONV_XML2UBF == svc.Conv_int {
+			ctype = "application/xml"
+
+			if rsp {
+				ctype = svc.Xml_content_type
+				schema = map[string]interface{}{"allOf": []interface{}{schema},
+					"xml": map[string]interface{}{"name": svc.Xml_root}}
+			}
+		}
+	case CONV_JSON2VIEW:
+		if rsp && "" != svc.Errfmt_view_rsp && len(fields) > 0 {
+			fields = append(append([]string{}, fields...), svc.Errfmt_view_rsp)
+		}
+
+		schema = g.viewSchema(fields)
+		ctype = "application/json"
+	case CONV_JSON:
+		schema = map[string]interface{}{"type": "object"}
+		ctype = "application/json"
+	case CONV_TEXT:
+		schema = map[string]interface{}{"type": "string"}
+		ctype = "text/plain"
+	case CONV_RAW:
+		schema = map[string]interface{}{"type": "string", "format": "binary"}
+		ctype = "application/octet-stream"
+	case CONV_SOAP:
+		//Envelope is not described by JSON schema
+		schema = map[string]interface{}{"type": "string",
+			"description": "SOAP 1.1 or 1.2 envelope"}
+		ctype = "text/xml"
+	}
+
+	//JSON error fields are added to the response object
+	if rsp && ERRORS_JSON == svc.Errors_int && "application/json" == ctype {
+		props := make(map[string]interface{})
+
+		if m := M_errfmtKey.FindStringSubmatch(svc.Errfmt_json_code); nil != m {
+			props[m[1]] = map[string]interface{}{"type": "integer"}
+		}
+
+		if m := M_errfmtKey.FindStringSubmatch(svc.Errfmt_json_msg); nil != m {
+			props[m[1]] = map[string]interface{}{"type": "string"}
+		}
+
+		schema = map[string]interface{}{"allOf": []interface{}{schema,
+			map[string]interface{}{"type": "object", "properties": props}}}
+	}
+
+	ret := map[string]interface{}{ctype: map[string]interface{}{"schema": schema}}
+
+	if CONV_SOAP == svc.Conv_int {
+		ret["application/soap+xml"] = ret[ctype]
+	}
+
+	return ret
+}
+
+//Error responses by HTTP status
+//@param svc	Service map
+//@param responses	responses to add to
+func (g *openAPIGen) errorResponses(svc *ServiceMap,
+	responses map[string]interface{}) {
+
+	switch svc.Errors_int {
+	case ERRORS_HTTP:
+		lookup := svc.Errors_fmt_http_map
+
+		if 0 == len(lookup) {
+			lookup = M_defaults.Errors_fmt_http_map
+		}
+
+		codes := make(map[int][]string)
+
+		for code, status := range lookup {
+			if strconv.Itoa(atmi.TPMINVAL) != code && 200 != status {
+				codes[status] = append(codes[status], code)
+			}
+		}
+
+		for status, list := range codes {
+			sort.Strings(list)
+			responses[strconv.Itoa(status)] = map[string]interface{}{
+				"description": "XATMI error " + strings.Join(list, ", ")}
+		}
+	case ERRORS_SOAP:
+		responses["500"] = map[string]interface{}{"description": "SOAP Fault",
+			"content": g.content(svc, nil, true)}
+		responses["400"] = map[string]interface{}{
+			"description": "SOAP 1.2 Sender Fault"}
+	}
+
+	if nil != svc.Auth_prov {
+		responses["401"] = map[string]interface{}{"description": "Not authenticated"}
+		responses["403"] = map[string]interface{}{"description": "Access denied"}
+	}
+
+	if nil != svc.Rate_lim {
+		responses["429"] = map[string]interface{}{"description": "Rate limit exceeded"}
+	}
+
+	if maxBodySize(svc) > 0 {
+		responses["413"] = map[string]interface{}{"description": "Request body too large"}
+	}
+}
+
+//Security requirement of the route, scheme is added to components
+//@param svc	Service map
+//@return security requirement or nil
+func (g *openAPIGen) securityReq(svc *ServiceMap) []interface{} {
+
+	var name string
+	var scheme map[string]interface{}
+
+	switch svc.Auth {
+	case AUTH_BASIC:
+		name = "basicAuth"
+		scheme = map[string]interface{}{"type": "http", "scheme": "basic"}
+	case AUTH_JWT:
+		name = "bearerAuth"
+		scheme = map[string]interface{}{"type": "http", "scheme": "bearer",
+			"bearerFormat": "JWT"}
+	case AUTH_APIKEY:
+		header := svc.Auth_header
+
+		if "" == header {
+			header = AUTH_HEADER_DEFAULT
+		}
+
+		name = "apiKey_" + header
+		scheme = map[string]interface{}{"type": "apiKey", "in": "header",
+			"name": header}
+	default:
+		return nil
+	}
+
+	g.security[name] = scheme
+
+	return []interface{}{map[string]interface{}{name: []string{}}}
+}
+
+//Get OpenAPI path of the route, template parameter patterns are removed
+//@param svc	Service map
+//@return path
+func openAPIPath(svc *ServiceMap) string {
+	return M_tplParam.ReplaceAllString(svc.Url, "{$1}")
+}
+
+//Describe the route operation for the method
+//@param svc	Service map (method resolved)
+//@param method	lower case HTTP method
+//@return operation object
+func (g *openAPIGen) operation(svc *ServiceMap, method string) map[string]interface{} {
+
+	summary := "Echo"
+
+	if "" != svc.Svc {
+		summary = "XATMI service " + svc.Svc
+	}
+
+	op := map[string]interface{}{
+		"summary": summary,
+		"operationId": method + "_" +
+			strings.Trim(M_opIdStrip.ReplaceAllString(openAPIPath(svc), "_"), "_"),
+	}
+
+	var params []interface{}
+
+	//Template parameters
+	if "t" == svc.Format || "template" == svc.Format {
+		for _, m := range M_tplParam.FindAllStringSubmatch(svc.Url, -1) {
+			schema := map[string]interface{}{"type": "string"}
+
+			if "" != m[2] {
+				schema["pattern"] = "^" + m[2][1:] + "$"
+			}
+
+			params = append(params, map[string]interface{}{"name": m[1],
+				"in": "path", "required": true, "schema": schema})
+		}
+	}
+
+	if svc.Parseform {
+		names := make([]string, 0, len(svc.Form_fields))
+
+		for name := range svc.Form_fields {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			params = append(params, map[string]interface{}{"name": name,
+				"in": "query", "schema": map[string]interface{}{"type": "string"}})
+		}
+	}
+
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if "get" != method {
+		op["requestBody"] = map[string]interface{}{
+			"content": g.content(svc, svc.Openapi_req, false)}
+	}
+
+	rspFields := svc.Openapi_rsp
+
+	if 0 == len(rspFields) {
+		rspFields = svc.Openapi_req
+	}
+
+	responses := map[string]interface{}{"200": map[string]interface{}{
+		"description": "Service response",
+		"content":     g.content(svc, rspFields, true)}}
+
+	//Async call without echo returns no buffer
+	if svc.Asynccall && !svc.Asyncecho {
+		responses["200"] = map[string]interface{}{"description": "Request accepted"}
+	}
+
+	g.errorResponses(svc, responses)
+	op["responses"] = responses
+
+	if sec := g.securityReq(svc); nil != sec {
+		op["security"] = sec
+	}
+
+	return op
+}
+
+//Generate OpenAPI 3 document of the configured routes
+//@param ac	ATMI Context
+//@param routes	routes
+//@return document or error
+func genOpenAPI(ac *atmi.ATMICtx, routes []ServiceMap) ([]byte, error) {
+
+	g := openAPIGen{ac: ac, schemas: make(map[string]interface{}),
+		security: make(map[string]interface{})}
+
+	if err := g.loadFieldTables(); nil != err {
+		return nil, err
+	}
+
+	if err := g.loadViews(); nil != err {
+		return nil, err
+	}
+
+	ac.TpLogInfo("OpenAPI: %d UBF fields, %d VIEWs loaded",
+		len(g.fields), len(g.viewNames))
+
+	paths := make(map[string]interface{})
+
+	for i := range routes {
+
+		svc := &routes[i]
+
+		if "r" == svc.Format || "regexp" == svc.Format {
+			ac.TpLogWarn("OpenAPI: regexp route [%s] cannot be described - skipped",
+				svc.Url)
+			continue
+		}
+
+		if CONV_WEBSOCKET == svc.Conv_int || CONV_SSE == svc.Conv_int ||
+			CONV_STATIC == svc.Conv_int {
+			ac.TpLogInfo("OpenAPI: streaming or static route [%s] skipped", svc.Url)
+			continue
+		}
+
+		item := make(map[string]interface{})
+
+		if len(svc.Methods_map) > 0 {
+			for method, msvc := range svc.Methods_map {
+				item[strings.ToLower(method)] = g.operation(msvc, strings.ToLower(method))
+			}
+		} else {
+			item["post"] = g.operation(svc, "post")
+
+			if svc.Parseform {
+				item["get"] = g.operation(svc, "get")
+			}
+		}
+
+		paths[openAPIPath(svc)] = item
+	}
+
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{"title": M_openapi_title,
+			"version": M_openapi_version},
+		"paths": paths,
+	}
+
+	components := make(map[string]interface{})
+
+	if len(g.schemas) > 0 {
+		components["schemas"] = g.schemas
+	}
+
+	if len(g.security) > 0 {
+		components["securitySchemes"] = g.security
+	}
+
+	if len(components) > 0 {
+		doc["components"] = components
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+//Serve the OpenAPI document
+//@param w	Response writer
+//@param req	HTTP Request
+func openAPIHandler(w http.ResponseWriter, req *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(M_openapi_doc)))
+	w.Write(M_openapi_doc)
+}
+
+//Generate the OpenAPI document, if requested by URL or command line
+//@param ac	ATMI Context
+//@return error or nil
+func initOpenAPI(ac *atmi.ATMICtx) error {
+
+	if "" == M_openapi_url && !M_openapi_cli {
+		return nil
+	}
+
+	doc, err := genOpenAPI(ac, M_handler.routes)
+
+	if nil != err {
+		ac.TpLogError("Failed to generate OpenAPI document: %s", err.Error())
+		return err
+	}
+
+	M_openapi_doc = doc
+
+	if "" != M_openapi_url {
+		ac.TpLogInfo("OpenAPI endpoint: [%s]", M_openapi_url)
+		M_handler.HandleBuiltin(M_openapi_url, http.HandlerFunc(openAPIHandler))
+	}
+
+	return nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
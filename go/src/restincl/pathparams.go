@@ -0,0 +1,168 @@
+/**
+ * @brief Path parameter (URL template & named regexp groups) support
+ *
+ * @file pathparams.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Template parameter, e.g. {acct} or {id:[0-9]+}
+var M_tplParam = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)(:[^{}]+)?\}`)
+
+//Check is route URL matched by regular expression
+//@param svc	Service map
+//@return true if regexp or template format
+func isRegexpFormat(svc *ServiceMap) bool {
+	switch svc.Format {
+	case "r", "regexp", "t", "template":
+		return true
+	}
+	return false
+}
+
+//Convert URL template to regular expression. Parameters are given in curly
+//braces, optionally with pattern after colon, e.g. /accounts/{acct}/tx/{id:[0-9]+}
+//Parameter without pattern matches single path segment.
+//@param tpl	URL template
+//@return regexp string (anchored)
+func templateToRegexp(tpl string) string {
+
+	var re strings.Builder
+	last := 0
+
+	re.WriteString("^")
+
+	for _, loc := range M_tplParam.FindAllStringSubmatchIndex(tpl, -1) {
+
+		re.WriteString(regexp.QuoteMeta(tpl[last:loc[0]]))
+
+		name := tpl[loc[2]:loc[3]]
+		pattern := "[^/]+"
+
+		if loc[4] >= 0 {
+			pattern = tpl[loc[4]+1 : loc[5]]
+		}
+
+		re.WriteString(fmt.Sprintf("(?P<%s>%s)", name, pattern))
+		last = loc[1]
+	}
+
+	re.WriteString(regexp.QuoteMeta(tpl[last:]))
+	re.WriteString("$")
+
+	return re.String()
+}
+
+//Compile the route URL to regexp, according to route format
+//@param ac	ATMI Context
+//@param svc	Service map
+//@return compiled expression or error
+func compileRoute(ac *atmi.ATMICtx, svc *ServiceMap) (*regexp.Regexp, error) {
+
+	expr := svc.Url
+
+	if svc.Format == "t" || svc.Format == "template" {
+		expr = templateToRegexp(svc.Url)
+		ac.TpLogInfo("Template [%s] converted to regexp [%s]", svc.Url, expr)
+	}
+
+	r, err := regexp.Compile(expr)
+
+	if nil != err {
+		return nil, err
+	}
+
+	//Check that mapped parameters are present in the route
+	names := make(map[string]bool)
+
+	for _, name := range r.SubexpNames() {
+		names[name] = true
+	}
+
+	for param := range svc.Pathparams {
+		if !names[param] {
+			return nil, fmt.Errorf("Route [%s]: path parameter [%s] not "+
+				"found in URL", svc.Url, param)
+		}
+	}
+
+	return r, nil
+}
+
+//Extract named path parameters from the request URL. Template parameters are
+//installed always, named groups of regexp only if mapped in pathparams.
+//@param svc	Service map
+//@param req	HTTP Request
+//@param fields	target field/key names to values, parameters are added here
+func getPathParams(svc *ServiceMap, req *http.Request, fields map[string][]string) {
+
+	if nil == svc.Path_re {
+		return
+	}
+
+	match := svc.Path_re.FindStringSubmatch(req.URL.Path)
+
+	if nil == match {
+		return
+	}
+
+	template := svc.Format == "t" || svc.Format == "template"
+
+	for i, name := range svc.Path_re.SubexpNames() {
+
+		if "" == name {
+			continue
+		}
+
+		fld, mapped := svc.Pathparams[name]
+
+		if !mapped && !template {
+			continue
+		}
+
+		target := name
+
+		if "" != fld {
+			target = fld
+		}
+
+		fields[target] = []string{match[i]}
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,313 @@
+/**
+ * @brief Token bucket rate limiting per route and per client
+ *
+ * @file ratelimit.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Client key types
+const (
+	RATE_KEY_IP       = "ip"
+	RATE_KEY_APIKEY   = "apikey"
+	RATE_KEY_HEADER   = "header:"
+	RATE_SWEEP_PERIOD = 60 //Idle client buckets cleanup period, seconds
+)
+
+//Token bucket
+type tokenBucket struct {
+	tokens float64   //Tokens available
+	last   time.Time //Last refill time
+}
+
+//Rate limiter of the route
+type rateLimiter struct {
+	mu          sync.Mutex
+	url         string
+	method      string  //Set if method route has own limits
+	rate        float64 //Route tokens per second
+	burst       float64 //Route bucket size
+	clientRate  float64 //Client tokens per second
+	clientBurst float64 //Client bucket size
+	clientKey   string  //Client key type
+	route       tokenBucket
+	clients     map[string]*tokenBucket
+	lastSweep   time.Time
+
+	rejectedRoute  uint64 //Requests rejected by route limit
+	rejectedClient uint64 //Requests rejected by client limit
+}
+
+//All limiters, for statistics
+var M_rate_limiters []*rateLimiter
+var M_rate_limiters_mu sync.Mutex
+
+//Take token from the bucket
+//@param now	current time
+//@param rate	tokens per second
+//@param burst	bucket size
+//@return true if token taken, otherwise time until next token is available
+func (b *tokenBucket) take(now time.Time, rate float64, burst float64) (bool, time.Duration) {
+
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+//Get the default burst for rate
+//@param burst	configured burst
+//@param rate	configured rate
+//@return burst to use
+func rateBurst(burst int, rate float64) float64 {
+
+	if burst > 0 {
+		return float64(burst)
+	}
+
+	return math.Max(1, math.Ceil(rate))
+}
+
+//Setup rate limiter for the route. Limiter already set is shared with the
+//route (method route without own limits) and is kept.
+//@param ac	ATMI Context
+//@param svc	Service map
+//@return error or nil
+func initRateLimit(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if nil != svc.Rate_lim {
+		return nil
+	}
+
+	if svc.Rate_limit < 0 || svc.Rate_client_limit < 0 {
+		return fmt.Errorf("Route [%s]: rate limits must not be negative", svc.Url)
+	}
+
+	if 0 == svc.Rate_limit && 0 == svc.Rate_client_limit {
+		return nil
+	}
+
+	key := svc.Rate_client_key
+
+	if "" == key {
+		key = RATE_KEY_IP
+	}
+
+	if RATE_KEY_IP != key && RATE_KEY_APIKEY != key &&
+		(!strings.HasPrefix(key, RATE_KEY_HEADER) || len(key) == len(RATE_KEY_HEADER)) {
+		return fmt.Errorf("Route [%s]: invalid rate_client_key [%s], "+
+			"expected 'ip', 'apikey' or 'header:<name>'", svc.Url, key)
+	}
+
+	lim := &rateLimiter{url: svc.Url, rate: svc.Rate_limit,
+		burst:      rateBurst(svc.Rate_burst, svc.Rate_limit),
+		clientRate: svc.Rate_client_limit, clientKey: key,
+		clientBurst: rateBurst(svc.Rate_client_burst, svc.Rate_client_limit),
+		clients:     make(map[string]*tokenBucket), lastSweep: time.Now()}
+
+	ac.TpLogInfo("Route [%s] rate limit: %g/s (burst %g), per client (%s): "+
+		"%g/s (burst %g)", svc.Url, lim.rate, lim.burst, lim.clientKey,
+		lim.clientRate, lim.clientBurst)
+
+	M_rate_limiters_mu.Lock()
+	M_rate_limiters = append(M_rate_limiters, lim)
+	M_rate_limiters_mu.Unlock()
+
+	svc.Rate_lim = lim
+
+	return nil
+}
+
+//Get client key of the request
+//@param svc	Service map
+//@param req	HTTP request
+//@return client key
+func (l *rateLimiter) getClientKey(svc *ServiceMap, req *http.Request) string {
+
+	switch {
+	case RATE_KEY_APIKEY == l.clientKey:
+		header := svc.Auth_header
+
+		if "" == header {
+			header = AUTH_HEADER_DEFAULT
+		}
+
+		return req.Header.Get(header)
+	case strings.HasPrefix(l.clientKey, RATE_KEY_HEADER):
+		return req.Header.Get(l.clientKey[len(RATE_KEY_HEADER):])
+	}
+
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+
+	if nil != err {
+		return req.RemoteAddr
+	}
+
+	return ip
+}
+
+//Drop client buckets which are idle for long enough to be full again
+//@param now	current time
+func (l *rateLimiter) sweep(now time.Time) {
+
+	if now.Sub(l.lastSweep) < RATE_SWEEP_PERIOD*time.Second {
+		return
+	}
+
+	refill := time.Duration(l.clientBurst / l.clientRate * float64(time.Second))
+
+	for k, b := range l.clients {
+		if now.Sub(b.last) > refill {
+			delete(l.clients, k)
+		}
+	}
+
+	l.lastSweep = now
+}
+
+//Check the limits for request
+//@param svc	Service map
+//@param req	HTTP request
+//@return true if allowed, otherwise wait time before retry and true if
+//	rejected by client limit
+func (l *rateLimiter) allow(svc *ServiceMap, req *http.Request) (bool, time.Duration, bool) {
+
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.clientRate > 0 {
+
+		l.sweep(now)
+
+		key := l.getClientKey(svc, req)
+		b, ok := l.clients[key]
+
+		if !ok {
+			b = &tokenBucket{}
+			l.clients[key] = b
+		}
+
+		if ok, wait := b.take(now, l.clientRate, l.clientBurst); !ok {
+			atomic.AddUint64(&l.rejectedClient, 1)
+			return false, wait, true
+		}
+	}
+
+	if l.rate > 0 {
+		if ok, wait := l.route.take(now, l.rate, l.burst); !ok {
+			atomic.AddUint64(&l.rejectedRoute, 1)
+			return false, wait, false
+		}
+	}
+
+	return true, 0, false
+}
+
+//Check rate limits of the request. If over the limit, 429 is sent with
+//Retry-After header.
+//@param svc	Service map
+//@param w	Response writer
+//@param req	HTTP Request
+//@return true if request may be processed
+func checkRateLimit(svc *ServiceMap, w http.ResponseWriter, req *http.Request) bool {
+
+	if nil == svc.Rate_lim {
+		return true
+	}
+
+	ok, wait, byClient := svc.Rate_lim.allow(svc, req)
+
+	if ok {
+		return true
+	}
+
+	retry := int(math.Ceil(wait.Seconds()))
+
+	if retry < 1 {
+		retry = 1
+	}
+
+	if byClient {
+		M_ac.TpLogWarn("URL [%s] caller %s: client rate limit exceeded "+
+			"(rejected by client limit: %d)", req.URL, req.RemoteAddr,
+			atomic.LoadUint64(&svc.Rate_lim.rejectedClient))
+	} else {
+		M_ac.TpLogWarn("URL [%s] caller %s: route rate limit exceeded "+
+			"(rejected by route limit: %d)", req.URL, req.RemoteAddr,
+			atomic.LoadUint64(&svc.Rate_lim.rejectedRoute))
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	rejectRequest(svc, w, NewHTTPError(atmi.TPELIMIT, "Rate limit exceeded",
+		http.StatusTooManyRequests))
+
+	return false
+}
+
+//Log rate limiter statistics
+//@param ac	ATMI Context
+func logRateLimitStats(ac *atmi.ATMICtx) {
+
+	M_rate_limiters_mu.Lock()
+	defer M_rate_limiters_mu.Unlock()
+
+	for _, l := range M_rate_limiters {
+		ac.TpLogWarn("Route [%s] rate limit rejections: route %d, client %d",
+			l.url, atomic.LoadUint64(&l.rejectedRoute),
+			atomic.LoadUint64(&l.rejectedClient))
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -39,6 +39,7 @@ package main
 
 //Hmm we might need to put in channels a free ATMI contexts..
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -46,12 +47,17 @@ import (
 	"os"
 	"os/signal"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 	u "ubftab"
 
 	atmi "github.com/endurox-dev/endurox-go"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
 /*
@@ -78,6 +84,10 @@ const (
 	//Return the error code as UBF response (usable only in case if CONV_JSON2UBF used)
 	ERRORS_JSON2UBF  = 5
 	ERRORS_JSON2VIEW = 6
+	//Return the error code as UBF fields in XML (usable with CONV_XML2UBF)
+	ERRORS_XML2UBF = 7
+	//Return the error code as SOAP Fault (set for CONV_SOAP)
+	ERRORS_SOAP = 8
 )
 
 //Conversion types resolved
@@ -87,6 +97,11 @@ const (
 	CONV_JSON      = 3
 	CONV_RAW       = 4
 	CONV_JSON2VIEW = 5
+	CONV_XML2UBF   = 6
+	CONV_SOAP      = 7
+	CONV_WEBSOCKET = 8
+	CONV_SSE       = 9
+	CONV_STATIC    = 10
 )
 
 //Defaults
@@ -102,6 +117,10 @@ const (
 	ERRFMT_TEXT_DEFAULT        = "%d: %s"
 	ASYNCCALL_DEFAULT          = false
 	WORKERS                    = 10 /* Number of worker processes */
+	DRAIN_TIMEOUT_DEFAULT      = 30 /* Seconds to wait for in-flight requests */
+	DRAIN_GRACE_DEFAULT        = 0  /* Seconds not ready before listener closes */
+	QUEUE_WAIT_MAX_DEFAULT     = 0  /* Wait for free worker forever, ms */
+	QUEUE_LEN_MAX_DEFAULT      = 0  /* Unlimited number of waiting requests */
 )
 
 //We will have most of the settings as defaults
@@ -161,6 +180,130 @@ type ServiceMap struct {
 	// Parsing request headers/Cookies
 	Parseheaders bool `json:"parseheaders"` // Default false
 	Parsecookies bool `json:"parsecookies"` // Default false
+
+	//Query string & form body (urlencoded/multipart) mapping to UBF fields
+	Parseform   bool              `json:"parseform"`   // Default false
+	Form_prefix string            `json:"form_prefix"` // Field name prefix
+	Form_fields map[string]string `json:"form_fields"` // param -> UBF field
+
+	//Verified client certificate attribute -> UBF field, JSON key or VIEW
+	//field. Attributes: subject, issuer, san, serial, fingerprint
+	Tls_client_fields map[string]string `json:"tls_client_fields"`
+
+	//Authentication: "basic" (htpasswd), "jwt" (Bearer, JWKS), "apikey"
+	//or "none" (default)
+	Auth         string   `json:"auth"`
+	Auth_file    string   `json:"auth_file"`    //htpasswd, JWKS or API key file
+	Auth_realm   string   `json:"auth_realm"`   //Basic realm
+	Auth_header  string   `json:"auth_header"`  //API key header
+	Auth_jwt_iss string   `json:"auth_jwt_iss"` //Required JWT issuer
+	Auth_jwt_aud string   `json:"auth_jwt_aud"` //Required JWT audience
+	Auth_allow   []string `json:"auth_allow"`   //Allowed principals, others 403
+	//Accept JWT without exp claim (never expiring)
+	Auth_jwt_exp_optional bool `json:"auth_jwt_exp_optional"`
+	//Principal -> UBF field, JSON key or VIEW field
+	Auth_field string `json:"auth_field"`
+	//JWT claim -> UBF field, JSON key or VIEW field
+	Auth_claims map[string]string `json:"auth_claims"`
+	Auth_prov   Authenticator     //Loaded provider
+	Auth_res    *AuthResult       //Caller of the request (route is copied)
+	//Authentication of the listener serving this copy of the route
+	Listener_auth *ServiceMap
+
+	//XATMI service authorizing the request (called with URL, method,
+	//client IP, headers and cookies)
+	Authsvc string `json:"authsvc"`
+	//Auth service response UBF field -> UBF field, JSON key or VIEW field
+	Authsvc_fields map[string]string `json:"authsvc_fields"`
+
+	//Token bucket rate limits (requests per second, 0 - not limited) for the
+	//route and per client. Client key: "ip", "apikey" or "header:<name>"
+	Rate_limit        float64 `json:"rate_limit"`
+	Rate_burst        int     `json:"rate_burst"`
+	Rate_client_limit float64 `json:"rate_client_limit"`
+	Rate_client_burst int     `json:"rate_client_burst"`
+	Rate_client_key   string  `json:"rate_client_key"`
+	Rate_lim          *rateLimiter
+
+	//CORS: allowed origins (exact, "*" or with "*" wildcard), methods,
+	//request headers, exposed response headers, credentials and max-age
+	Cors_origins     []string `json:"cors_origins"`
+	Cors_methods     []string `json:"cors_methods"`
+	Cors_headers     []string `json:"cors_headers"`
+	Cors_expose      []string `json:"cors_expose"`
+	Cors_credentials bool     `json:"cors_credentials"`
+	Cors_max_age     int      `json:"cors_max_age"`
+	Cors_re          []*regexp.Regexp
+
+	//Compress responses (gzip, deflate or br, as accepted by client) which
+	//are at least compress_min_size bytes
+	Compress          bool `json:"compress"`
+	Compress_min_size int  `json:"compress_min_size"`
+
+	//Max request body size in bytes (after decoding), 0 - not limited
+	Max_body_size int `json:"max_body_size"`
+
+	//xml2ubf: response root element, namespace and content type
+	Xml_root         string `json:"xml_root"`
+	Xml_ns           string `json:"xml_ns"`
+	Xml_content_type string `json:"xml_content_type"`
+
+	//soap: SOAP action or operation element -> service name. If not
+	//mapped, "svc" is called.
+	Soap_svcs map[string]string `json:"soap_svcs"`
+	Soap_req  *soapRequest      //Request state (route is copied per request)
+
+	//websocket: message conversion (json2ubf, json or text)
+	Ws_conv     string `json:"ws_conv"`
+	Ws_conv_int int
+
+	//Event broker subscription (websocket, sse): event expression and filter
+	Ev_mask   string `json:"ev_mask"`
+	Ev_filter string `json:"ev_filter"`
+
+	//sse: seconds between heartbeat comments (0 - off), events kept for
+	//Last-Event-ID resume (0 - no resume)
+	Sse_heartbeat int `json:"sse_heartbeat"`
+	Sse_buffer    int `json:"sse_buffer"`
+
+	//static: directory served under the route URL, directory index file,
+	//single page app (index for unknown paths), Cache-Control max-age
+	Static_dir     string `json:"static_dir"`
+	Static_index   string `json:"static_index"`
+	Static_spa     bool   `json:"static_spa"`
+	Static_max_age int    `json:"static_max_age"`
+
+	//JSON Schema (draft 2020-12) file for request validation (json2ubf,
+	//json2view, json)
+	Schema     string `json:"schema"`
+	Schema_sch *jsonschema.Schema
+
+	//OpenAPI: request and response UBF fields (json2ubf, xml2ubf) or VIEWs
+	//(json2view). If not set, all fields/VIEWs are described. Response
+	//defaults to request.
+	Openapi_req []string `json:"openapi_req"`
+	Openapi_rsp []string `json:"openapi_rsp"`
+
+	//Tracing: trace id and restincl span's traceparent -> UBF field, JSON
+	//key or VIEW field
+	Trace_field       string     `json:"trace_field"`
+	Traceparent_field string     `json:"traceparent_field"`
+	Trace             *traceSpan //Request span (route is copied per request)
+
+	Access *accessEntry //Access log record of the request
+
+	//Path parameters (template or named regexp groups): param -> UBF field,
+	//JSON key or VIEW field. If not mapped, parameter name is used.
+	Pathparams map[string]string `json:"pathparams"`
+	Path_re    *regexp.Regexp    //Compiled route in regexp/template format
+
+	//HTTP method routing: verb -> service name or JSON block overriding
+	//the route settings. Route level only.
+	Methods map[string]json.RawMessage `json:"methods"`
+	//Above resolved to service maps per upper case verb
+	Methods_map map[string]*ServiceMap
+	//Value for "Allow" header in case of 405
+	Methods_allow string
 }
 
 //Route information structure
@@ -175,6 +318,10 @@ type RegexpHandler struct {
 	regexpRoutes   []*route
 	urlMap         map[string]ServiceMap
 	defaultHandler map[string]http.Handler
+	builtinHandler map[string]http.Handler //Gateway's own endpoints
+	routes         []ServiceMap            //All routes, in config order
+	staticRoutes   []*route                //Static directories, longest first
+	auth           *ServiceMap             //Listener authentication, if any
 }
 
 var M_port int = atmi.FAIL
@@ -198,10 +345,21 @@ var M_convs = map[string]int{
 	"json":      CONV_JSON,
 	"raw":       CONV_RAW,
 	"json2view": CONV_JSON2VIEW,
+	"xml2ubf":   CONV_XML2UBF,
+	"soap":      CONV_SOAP,
+	"websocket": CONV_WEBSOCKET,
+	"sse":       CONV_SSE,
+	"static":    CONV_STATIC,
 }
 
 var M_workers int
-var M_ac *atmi.ATMICtx //Mainly shared for logging....
+var M_drain_timeout int       //Shutdown drain time-out, seconds
+var M_drain_grace int         //Shutdown readiness grace period, seconds
+var M_server *http.Server     //HTTP server
+var M_stopping bool           //Shutdown is requested
+var M_server_mutex sync.Mutex //Guards M_server and M_stopping
+var M_shutdown_done chan bool //Closed when server drain is complete
+var M_ac *atmi.ATMICtx        //Mainly shared for logging....
 var M_handler RegexpHandler
 
 func (h *RegexpHandler) Handler(pattern *regexp.Regexp, handler http.Handler, svc ServiceMap) {
@@ -214,7 +372,12 @@ func (h *RegexpHandler) Handler(pattern *regexp.Regexp, handler http.Handler, sv
 }
 
 func (h *RegexpHandler) HandleFunc(pattern *regexp.Regexp, svc ServiceMap) {
-	if svc.Format == "regexp" || svc.Format == "r" {
+	h.routes = append(h.routes, svc)
+	if CONV_STATIC == svc.Conv_int {
+		h.handleStatic(svc, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			dispatchRequest(w, r, svc)
+		}))
+	} else if nil != pattern {
 		h.regexpRoutes = append(h.regexpRoutes, &route{pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			dispatchRequest(w, r, svc)
 		})})
@@ -226,9 +389,37 @@ func (h *RegexpHandler) HandleFunc(pattern *regexp.Regexp, svc ServiceMap) {
 	}
 }
 
+//Register gateway's own endpoint (e.g. health), served before the routes
+func (h *RegexpHandler) HandleBuiltin(url string, handler http.Handler) {
+	if _, exists := h.urlMap[url]; exists {
+		M_ac.TpLogWarn("Route [%s] is shadowed by built-in endpoint", url)
+	}
+	h.builtinHandler[url] = handler
+}
+
 func (h *RegexpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ae, w, r := startAccess(w, r)
+	if nil != ae {
+		defer endAccess(ae, r)
+	}
+
+	if handler, ok := h.builtinHandler[r.URL.Path]; ok {
+		//Routes check the listener authentication in dispatchRequest()
+		if nil != h.auth {
+			if _, err := authenticate(M_ac, h.auth, w, r); nil != err {
+				rejectRequest(h.auth, w, err)
+				return
+			}
+		}
+
+		handler.ServeHTTP(w, r)
+		return
+	}
+
 	svc := h.urlMap[r.URL.Path]
-	if svc.Svc != "" || svc.Echo {
+	if svc.Svc != "" || svc.Echo || len(svc.Methods_map) > 0 ||
+		CONV_SOAP == svc.Conv_int || CONV_WEBSOCKET == svc.Conv_int ||
+		CONV_SSE == svc.Conv_int {
 		h.defaultHandler[r.URL.Path].ServeHTTP(w, r)
 		return
 	}
@@ -239,6 +430,13 @@ func (h *RegexpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+
+	for _, route := range h.staticRoutes {
+		if route.pattern.MatchString(r.URL.Path) {
+			route.handler.ServeHTTP(w, r)
+			return
+		}
+	}
 	// no pattern matched; send 404 response
 	http.NotFound(w, r)
 }
@@ -260,6 +458,9 @@ func remapErrors(svc *ServiceMap) error {
 	case "json2view":
 		svc.Errors_int = ERRORS_JSON2VIEW
 		break
+	case "xml2ubf":
+		svc.Errors_int = ERRORS_XML2UBF
+		break
 	case "text":
 		svc.Errors_int = ERRORS_TEXT
 		break
@@ -273,23 +474,67 @@ func remapErrors(svc *ServiceMap) error {
 //Run the listener
 func apprun(ac *atmi.ATMICtx) error {
 
-	var err error
-	//TODO: Some works needed for TLS...
-	listenOn := fmt.Sprintf("%s:%d", M_ip, M_port)
-	ac.TpLog(atmi.LOG_INFO, "About to listen on: (ip: %s, port: %d) %s",
-		M_ip, M_port, listenOn)
-	if TRUE == M_tls_enable {
-
-		/* To prepare cert (self-signed) do following steps:
-		 * - TODO
-		 */
-		err = http.ListenAndServeTLS(listenOn, M_tls_cert_file, M_tls_key_file, &M_handler)
-		ac.TpLog(atmi.LOG_ERROR, "ListenAndServeTLS() failed: %s", err)
-	} else {
-		err = http.ListenAndServe(listenOn, &M_handler)
-		ac.TpLog(atmi.LOG_ERROR, "ListenAndServe() failed: %s", err)
+	primary := M_listener_main
+
+	if nil == primary {
+		primary = &listener{Name: LISTENER_MAIN, handler: &M_handler}
+	}
+
+	primary.Ip = M_ip
+	primary.Port = M_port
+	primary.tlsSettings = tlsSettings{Tls_enable: TRUE == M_tls_enable,
+		Tls_cert_file:   M_tls_cert_file,
+		Tls_key_file:    M_tls_key_file,
+		Tls_ca_file:     M_tls_ca_file,
+		Tls_client_auth: M_tls_client_auth,
+		Tls_min_version: M_tls_min_version,
+		Tls_ciphers:     M_tls_ciphers}
+
+	all := append([]*listener{primary}, M_listeners...)
+
+	for _, l := range all {
+		if err := l.newServer(ac); nil != err {
+			return err
+		}
+	}
+
+	//Shutdown may be requested before the server is published
+	M_server_mutex.Lock()
+	stopping := M_stopping
+
+	if !stopping {
+		M_server = primary.server
+	}
+
+	M_server_mutex.Unlock()
+
+	if stopping {
+		ac.TpLogWarn("Shutdown requested - not serving")
+		return nil
+	}
+
+	startAdmin(ac)
+
+	errs := make(chan error, len(all))
+
+	for _, l := range all {
+		go func(l *listener) {
+			errs <- l.serve()
+		}(l)
+	}
+
+	//Any listener failure terminates the process
+	err := <-errs
+
+	if http.ErrServerClosed == err {
+		//Shutdown requested, wait for in-flight requests to complete
+		ac.TpLogWarn("HTTP server closed - waiting for drain")
+		<-M_shutdown_done
+		return nil
 	}
 
+	ac.TpLog(atmi.LOG_ERROR, "ListenAndServe() failed: %s", err)
+
 	return err
 }
 
@@ -297,10 +542,112 @@ func apprun(ac *atmi.ATMICtx) error {
 
 func dispatchRequest(w http.ResponseWriter, req *http.Request, svc ServiceMap) {
 
+	w, done := metricsStart(svc.Url, w, req)
+	defer done()
+
+	//Resolved route and ATMI result go to access log
+	ae := getAccess(req)
+
+	if nil != ae {
+		ae.svc = &svc
+	}
+
+	//Preflight is answered without calling the service
+	if handleCORS(&svc, w, req) {
+		return
+	}
+
+	//Resolve the service by HTTP method, if route is method aware
+	if len(svc.Methods_map) > 0 {
+		msvc, ok := svc.Methods_map[req.Method]
+
+		if !ok {
+			M_ac.TpLogWarn("URL [%s] method [%s] not allowed (allowed: %s)",
+				req.URL, req.Method, svc.Methods_allow)
+			w.Header().Set("Allow", svc.Methods_allow)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+				http.StatusMethodNotAllowed)
+			return
+		}
+
+		lauth := svc.Listener_auth
+		svc = *msvc
+		svc.Listener_auth = lauth
+	}
+
+	svc.Access = ae
+
+	//Trace context is returned in headers, span ends with the response
+	if svc.Trace = startTrace(&svc, w, req); nil != svc.Trace {
+		tw := &statusWriter{ResponseWriter: w}
+		w = tw
+		defer func() { endTrace(&svc, req, tw.status) }()
+	}
+
+	//SOAP version is needed for the Faults from now on
+	if CONV_SOAP == svc.Conv_int {
+		svc.Soap_req = newSOAPRequest(req)
+	}
+
+	if !checkRateLimit(&svc, w, req) {
+		return
+	}
+
+	//Local credentials are checked before the XATMI context is taken, so
+	//that unauthenticated requests do not occupy the workers. Listener
+	//authentication goes first, its caller is used if route has no own auth.
+	if lauth := svc.Listener_auth; nil != lauth {
+		res, err := authenticate(M_ac, lauth, w, req)
+
+		if nil != err {
+			rejectRequest(lauth, w, err)
+			return
+		}
+
+		if nil == svc.Auth_prov {
+			svc.Auth_res = res
+
+			if "" == svc.Auth_field {
+				svc.Auth_field = lauth.Auth_field
+			}
+
+			if 0 == len(svc.Auth_claims) {
+				svc.Auth_claims = lauth.Auth_claims
+			}
+		}
+	}
+
+	if nil != svc.Auth_prov {
+		res, err := authenticate(M_ac, &svc, w, req)
+
+		if nil != err {
+			rejectRequest(&svc, w, err)
+			return
+		}
+
+		svc.Auth_res = res
+	}
+
+	//Connection is served with own context
+	if CONV_WEBSOCKET == svc.Conv_int {
+		serveWebSocket(&svc, w, req)
+		return
+	} else if CONV_SSE == svc.Conv_int {
+		serveSSE(&svc, w, req)
+		return
+	} else if CONV_STATIC == svc.Conv_int {
+		serveStatic(&svc, w, req)
+		return
+	}
+
 	M_ac.TpLog(atmi.LOG_DEBUG, "URL [%s] getting free goroutine caller: %s",
 		req.URL, req.RemoteAddr)
 
-	nr := <-M_freechan
+	nr, ok := getFreeContext(&svc, w, req)
+
+	if !ok {
+		return
+	}
 
 	M_ac.TpLogInfo("Got free goroutine, nr %d", nr)
 
@@ -355,6 +702,222 @@ func parseHTTPErrorMap(ac *atmi.ATMICtx, svc *ServiceMap) error {
 	return nil
 }
 
+//Validate and resolve the route settings (error handling, conversion, views)
+//@param ac	ATMI Context
+//@param svc	Service map
+//@return error or nil
+func initServiceMap(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	//Parse http errors for
+	if svc.Errors_fmt_http_map_str != "" {
+		if err := parseHTTPErrorMap(ac, svc); err != nil {
+			return err
+		}
+	}
+
+	remapErrors(svc)
+	//Map the conv
+	svc.Conv_int = M_convs[svc.Conv]
+
+	if svc.Conv_int == 0 {
+		return fmt.Errorf("Invalid conv: %s", svc.Conv)
+	}
+
+	//Validate view settings (if any)
+	if err := VIEWSvcValidateSettings(ac, svc); err != nil {
+		return err
+	}
+
+	if err := validateTLSClientFields(svc); err != nil {
+		return err
+	}
+
+	if err := initAuth(ac, svc); err != nil {
+		return err
+	}
+
+	if err := initRateLimit(ac, svc); err != nil {
+		return err
+	}
+
+	if err := initCORS(ac, svc); err != nil {
+		return err
+	}
+
+	if err := initSchema(ac, svc); err != nil {
+		return err
+	}
+
+	if err := initWebSocket(svc); err != nil {
+		return err
+	}
+
+	if err := initSSE(svc); err != nil {
+		return err
+	}
+
+	if err := initStatic(svc); err != nil {
+		return err
+	}
+
+	//SOAP errors are always returned as Faults
+	if svc.Conv_int == CONV_SOAP {
+		svc.Errors_int = ERRORS_SOAP
+	}
+
+	if svc.Errors_int == ERRORS_XML2UBF && svc.Conv_int != CONV_XML2UBF {
+		return fmt.Errorf("Route [%s]: 'xml2ubf' errors work only with "+
+			"'xml2ubf' conv", svc.Url)
+	}
+
+	if svc.Conv_int == CONV_XML2UBF && svc.Errors_int != ERRORS_XML2UBF &&
+		svc.Errors_int != ERRORS_HTTP {
+		return fmt.Errorf("Route [%s]: 'xml2ubf' conv supports only "+
+			"'xml2ubf' or 'http' errors", svc.Url)
+	}
+
+	if svc.Parseform && svc.Conv_int != CONV_JSON2UBF {
+		return fmt.Errorf("Route [%s]: 'parseform' works only with "+
+			"'json2ubf' conv", svc.Url)
+	}
+
+	return nil
+}
+
+//Copy the service map, so that maps & lists can be overridden by the JSON
+//config without altering the source (e.g. defaults)
+//@param svc	Service map to copy
+//@return copy
+func copyServiceMap(svc *ServiceMap) ServiceMap {
+
+	ret := *svc
+
+	copyMap := func(m map[string]string) map[string]string {
+		if m == nil {
+			return nil
+		}
+		c := make(map[string]string, len(m))
+		for k, v := range m {
+			c[k] = v
+		}
+		return c
+	}
+
+	ret.Form_fields = copyMap(svc.Form_fields)
+	ret.Tls_client_fields = copyMap(svc.Tls_client_fields)
+	ret.Pathparams = copyMap(svc.Pathparams)
+	ret.Auth_claims = copyMap(svc.Auth_claims)
+	ret.Authsvc_fields = copyMap(svc.Authsvc_fields)
+	ret.Soap_svcs = copyMap(svc.Soap_svcs)
+
+	copyList := func(l []string) []string {
+		if l == nil {
+			return nil
+		}
+		return append([]string{}, l...)
+	}
+
+	ret.Auth_allow = copyList(svc.Auth_allow)
+	ret.Cors_origins = copyList(svc.Cors_origins)
+	ret.Cors_methods = copyList(svc.Cors_methods)
+	ret.Cors_headers = copyList(svc.Cors_headers)
+	ret.Cors_expose = copyList(svc.Cors_expose)
+	ret.Openapi_req = copyList(svc.Openapi_req)
+	ret.Openapi_rsp = copyList(svc.Openapi_rsp)
+
+	return ret
+}
+
+//Resolve per HTTP method settings of the route. Each verb is initialized
+//from the route and then overridden by the verb's JSON block. If the verb is
+//set to string, it is the service name to call.
+//@param ac	ATMI Context
+//@param svc	Service map (route)
+//@return error or nil
+func parseMethods(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if len(svc.Methods) == 0 {
+		return nil
+	}
+
+	svc.Methods_map = make(map[string]*ServiceMap)
+	allow := []string{}
+
+	for verb, cfg := range svc.Methods {
+
+		verb = strings.ToUpper(strings.TrimSpace(verb))
+
+		if verb == "" {
+			return fmt.Errorf("Route [%s]: empty method name", svc.Url)
+		}
+
+		if _, exists := svc.Methods_map[verb]; exists {
+			return fmt.Errorf("Route [%s]: duplicate method [%s]", svc.Url, verb)
+		}
+
+		msvc := copyServiceMap(svc)
+		msvc.Methods = nil
+		msvc.Methods_map = nil
+		msvc.Methods_allow = ""
+
+		var svcName string
+
+		if err := json.Unmarshal(cfg, &svcName); err == nil {
+			if svcName != "" {
+				msvc.Svc = svcName
+			}
+		} else if err := json.Unmarshal(cfg, &msvc); err != nil {
+			ac.TpLogError("Route [%s]: failed to parse method [%s] "+
+				"config: %s", svc.Url, verb, err)
+			return fmt.Errorf("Route [%s]: failed to parse method [%s] "+
+				"config: %s", svc.Url, verb, err)
+		} else {
+			//CORS is processed before the method is resolved (preflight
+			//is sent with OPTIONS), thus it is route level only
+			var keys map[string]json.RawMessage
+			json.Unmarshal(cfg, &keys)
+
+			for key := range keys {
+				key = strings.ToLower(key)
+
+				if strings.HasPrefix(key, "cors_") {
+					ac.TpLogError("Route [%s]: method [%s]: [%s] is route "+
+						"level setting only", svc.Url, verb, key)
+					return fmt.Errorf("Route [%s]: method [%s]: [%s] is route "+
+						"level setting only", svc.Url, verb, key)
+				} else if strings.HasPrefix(key, "rate_") {
+					//Own limits, otherwise route's limiter is shared
+					msvc.Rate_lim = nil
+				}
+			}
+		}
+
+		if msvc.Svc == "" && !msvc.Echo {
+			return fmt.Errorf("Route [%s]: method [%s] has no service "+
+				"configured", svc.Url, verb)
+		}
+
+		if err := initServiceMap(ac, &msvc); err != nil {
+			return err
+		}
+
+		if nil != msvc.Rate_lim && msvc.Rate_lim != svc.Rate_lim {
+			msvc.Rate_lim.method = verb
+		}
+
+		ac.TpLogInfo("Route [%s] method [%s]:", svc.Url, verb)
+		printSvcSummary(ac, &msvc)
+
+		svc.Methods_map[verb] = &msvc
+		allow = append(allow, verb)
+	}
+
+	sort.Strings(allow)
+	svc.Methods_allow = strings.Join(allow, ", ")
+
+	return nil
+}
+
 //Print the summary of the service after init
 func printSvcSummary(ac *atmi.ATMICtx, svc *ServiceMap) {
 	ac.TpLogWarn("Service: %s, Url: %s, Async mode: %t, Log request svc: [%s], Errors:%d (%s), Async echo %t",
@@ -372,6 +935,7 @@ func appinit(ac *atmi.ATMICtx) error {
 	//runtime.LockOSThread()
 	M_handler.urlMap = make(map[string]ServiceMap)
 	M_handler.defaultHandler = make(map[string]http.Handler)
+	M_handler.builtinHandler = make(map[string]http.Handler)
 
 	//Setup default configuration
 	M_defaults.Errors_int = ERRORS_DEFAULT
@@ -384,8 +948,27 @@ func appinit(ac *atmi.ATMICtx) error {
 	M_defaults.Errfmt_text = ERRFMT_TEXT_DEFAULT
 	M_defaults.Asynccall = ASYNCCALL_DEFAULT
 	M_defaults.Errfmt_view_onsucc = ERRFMT_VIEW_ONSUCC_DEFAULT
+	M_defaults.Compress_min_size = COMPRESS_MIN_SIZE_DEFAULT
+	M_defaults.Xml_root = XML_ROOT_DEFAULT
+	M_defaults.Xml_content_type = XML_CONTENT_TYPE_DEFAULT
+	M_defaults.Sse_heartbeat = SSE_HEARTBEAT_DEFAULT
+	M_defaults.Sse_buffer = SSE_BUFFER_DEFAULT
 
 	M_workers = WORKERS
+	M_drain_timeout = DRAIN_TIMEOUT_DEFAULT
+	M_drain_grace = DRAIN_GRACE_DEFAULT
+	M_queue_wait_max = QUEUE_WAIT_MAX_DEFAULT
+	M_queue_len_max = QUEUE_LEN_MAX_DEFAULT
+	M_openapi_title = OPENAPI_TITLE_DEFAULT
+	M_openapi_version = OPENAPI_VERSION_DEFAULT
+	M_read_header_timeout = READ_HEADER_TIMEOUT_DEFAULT
+	M_idle_timeout = IDLE_TIMEOUT_DEFAULT
+	M_shutdown_done = make(chan bool)
+	M_stream_max = STREAM_MAX_DEFAULT
+	M_access_log_max_files = ACCESS_LOG_MAX_FILES_DEFAULT
+	M_http2_max_streams = HTTP2_MAX_STREAMS_DEFAULT
+	M_http2_ping_timeout = HTTP2_PING_TIMEOUT_DEFAULT
+	M_streams_stop = make(chan bool)
 
 	if err := ac.TpInit(); err != nil {
 		return errors.New(err.Error())
@@ -442,6 +1025,85 @@ func appinit(ac *atmi.ATMICtx) error {
 		case "workers":
 			M_workers, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
 			break
+		case "drain_timeout":
+			M_drain_timeout, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "drain_grace":
+			M_drain_grace, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "read_timeout":
+			M_read_timeout, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "read_header_timeout":
+			M_read_header_timeout, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "write_timeout":
+			M_write_timeout, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "idle_timeout":
+			M_idle_timeout, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "max_header_bytes":
+			M_max_header_bytes, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "max_body_size":
+			M_max_body_size, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "http2":
+			M_http2, _ = buf.BGetInt16(u.EX_CC_VALUE, occ)
+			break
+		case "h2c":
+			M_h2c, _ = buf.BGetInt16(u.EX_CC_VALUE, occ)
+			break
+		case "http2_max_streams":
+			M_http2_max_streams, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "http2_ping_interval":
+			M_http2_ping_interval, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "http2_ping_timeout":
+			M_http2_ping_timeout, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "keepalive":
+			M_keepalive, _ = buf.BGetInt16(u.EX_CC_VALUE, occ)
+			break
+		case "trace":
+			M_trace, _ = buf.BGetInt16(u.EX_CC_VALUE, occ)
+			break
+		case "trace_exporter":
+			M_trace_exporter, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "trace_file":
+			M_trace_file, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "trace_endpoint":
+			M_trace_endpoint, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "trace_service":
+			M_trace_service, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "access_log":
+			M_access_log, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "access_log_format":
+			M_access_log_format, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "access_log_max_size":
+			M_access_log_max_size, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "access_log_max_files":
+			M_access_log_max_files, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "stream_max":
+			M_stream_max, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "queue_wait_max":
+			M_queue_wait_max, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			break
+		case "queue_len_max":
+			queueLenMax, _ := buf.BGetInt(u.EX_CC_VALUE, occ)
+			M_queue_len_max = int32(queueLenMax)
+			break
 		case "gencore":
 			gencore, _ := buf.BGetInt(u.EX_CC_VALUE, occ)
 
@@ -459,6 +1121,32 @@ func appinit(ac *atmi.ATMICtx) error {
 		case "ip":
 			M_ip, _ = buf.BGetString(u.EX_CC_VALUE, occ)
 			break
+		case "admin_port":
+			M_admin_port, _ = buf.BGetInt(u.EX_CC_VALUE, occ)
+			M_metrics_enable = M_admin_port > 0
+			break
+		case "admin_ip":
+			M_admin_ip, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "healthz_url":
+			M_healthz_url, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "readyz_url":
+			M_readyz_url, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "openapi_url":
+			M_openapi_url, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "openapi_title":
+			M_openapi_title, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "openapi_version":
+			M_openapi_version, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "ready_svcs":
+			readySvcs, _ := buf.BGetString(u.EX_CC_VALUE, occ)
+			parseReadySvcs(readySvcs)
+			break
 		case "tls_enable":
 			M_tls_enable, _ = buf.BGetInt16(u.EX_CC_VALUE, occ)
 			break
@@ -468,6 +1156,18 @@ func appinit(ac *atmi.ATMICtx) error {
 		case "tls_key_file":
 			M_tls_key_file, _ = buf.BGetString(u.EX_CC_VALUE, occ)
 			break
+		case "tls_ca_file":
+			M_tls_ca_file, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "tls_client_auth":
+			M_tls_client_auth, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "tls_min_version":
+			M_tls_min_version, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
+		case "tls_ciphers":
+			M_tls_ciphers, _ = buf.BGetString(u.EX_CC_VALUE, occ)
+			break
 		case "defaults":
 			//Override the defaults
 			jsonDefault, _ := buf.BGetByteArr(u.EX_CC_VALUE, occ)
@@ -480,7 +1180,7 @@ func appinit(ac *atmi.ATMICtx) error {
 			}
 
 			if M_defaults.Errors_fmt_http_map_str != "" {
-				if jerr := parseHTTPErrorMap(ac, &M_defaults); err != nil {
+				if jerr := parseHTTPErrorMap(ac, &M_defaults); jerr != nil {
 					return jerr
 				}
 			}
@@ -503,13 +1203,23 @@ func appinit(ac *atmi.ATMICtx) error {
 		default:
 			//Assign the defaults
 
+			if strings.HasPrefix(fldName, LISTENER_PREFIX) {
+				cfgVal, _ := buf.BGetString(u.EX_CC_VALUE, occ)
+
+				if err := addListener(ac, fldName, cfgVal); nil != err {
+					return err
+				}
+			}
+
 			//Load routes...
 			if strings.HasPrefix(fldName, "/") {
 				cfgVal, _ := buf.BGetString(u.EX_CC_VALUE, occ)
 
 				ac.TpLogInfo("Got route config [%s]", cfgVal)
 
-				tmp := M_defaults
+				tmp := copyServiceMap(&M_defaults)
+				//Methods are route level only
+				tmp.Methods = nil
 
 				//Override the stuff from current config
 
@@ -529,40 +1239,33 @@ func appinit(ac *atmi.ATMICtx) error {
 					fldName, tmp.Svc)
 				tmp.Url = fldName
 
-				//Parse http errors for
-				if tmp.Errors_fmt_http_map_str != "" {
-					if jerr := parseHTTPErrorMap(ac, &tmp); err != nil {
-						return jerr
-					}
-				}
-
-				remapErrors(&tmp)
-				//Map the conv
-				tmp.Conv_int = M_convs[tmp.Conv]
-
-				if tmp.Conv_int == 0 {
-					return fmt.Errorf("Invalid conv: %s", tmp.Conv)
-				}
-
-				//Validate view settings (if any)
-				if err = VIEWSvcValidateSettings(ac, &tmp); err != nil {
+				if err = initServiceMap(ac, &tmp); err != nil {
 					return err
 				}
 
 				printSvcSummary(ac, &tmp)
 
 				ac.TpLogInfo("Checking if service uses regexp")
-				//Add to HTTP listener
-				if tmp.Format == "regexp" || tmp.Format == "r" {
-					if r, err := regexp.Compile(fldName); err == nil {
+				if isRegexpFormat(&tmp) {
+					if r, err := compileRoute(ac, &tmp); err == nil {
 						ac.TpLogInfo("Regexp compiled")
-						M_handler.HandleFunc(r, tmp)
+						tmp.Path_re = r
 					} else {
-						ac.TpLogInfo("Failed to compile regexp [%s]", err.Error())
+						ac.TpLogError("Failed to compile regexp [%s]", err.Error())
+						return err
 					}
-				} else {
-					M_handler.HandleFunc(nil, tmp)
+				} else if len(tmp.Pathparams) > 0 {
+					return fmt.Errorf("Route [%s]: 'pathparams' requires "+
+						"'regexp' or 'template' format", fldName)
+				}
+
+				//Resolve HTTP method specific settings
+				if err = parseMethods(ac, &tmp); err != nil {
+					return err
 				}
+
+				//Add to HTTP listener
+				M_handler.HandleFunc(tmp.Path_re, tmp)
 			}
 			break
 		}
@@ -649,10 +1352,29 @@ func appinit(ac *atmi.ATMICtx) error {
 
 	}
 
+	if err := initListeners(ac); nil != err {
+		return err
+	}
+
+	if err := initTrace(ac); nil != err {
+		return err
+	}
+
+	if err := initAccessLog(ac); nil != err {
+		return err
+	}
+
 	ac.TpLogInfo("About to init woker pool, number of workers: %d", M_workers)
 
 	initPool(ac)
 
+	M_config_loaded = true
+	initHealth(ac)
+
+	if err := initOpenAPI(ac); nil != err {
+		return err
+	}
+
 	return nil
 }
 
@@ -672,16 +1394,74 @@ func unInit(ac *atmi.ATMICtx, retCode int) {
 	os.Exit(retCode)
 }
 
-//Handle the shutdown
+//Handle the shutdown. Readiness fails for drain_grace, then new connections
+//are refused and in-flight requests are completed (up to drain_timeout), then
+//main thread terminates contexts. Second signal forces the exit.
 func handleShutdown(ac *atmi.ATMICtx) {
 	signalChannel := make(chan os.Signal, 2)
 	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		sig := <-signalChannel
+
+		ac.TpLogWarn("Got signal %d - draining in-flight requests "+
+			"(timeout %d sec)", sig, M_drain_timeout)
+
+		go func() {
+			sig := <-signalChannel
+			ac.TpLogError("Got signal %d while draining - forcing exit", sig)
+			os.Exit(atmi.FAIL)
+		}()
+
+		//Readiness fails from now on
+		atomic.StoreInt32(&M_draining, 1)
+
+		M_server_mutex.Lock()
+		M_stopping = true
+		server := M_server
+		M_server_mutex.Unlock()
+
+		if nil == server {
+			//Not serving yet, apprun() returns without serving
+			return
+		}
+
+		//Let load balancer see failing readiness before listener is closed
+		if M_drain_grace > 0 {
+			ac.TpLogWarn("Readiness fails - closing listeners in %d sec",
+				M_drain_grace)
+			time.Sleep(time.Duration(M_drain_grace) * time.Second)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(),
+			time.Duration(M_drain_timeout)*time.Second)
+		defer cancel()
+
+		errL := make(chan error, 1)
+
+		go func() {
+			errL <- shutdownListeners(ctx)
+		}()
+
+		if err := server.Shutdown(ctx); nil != err {
+			ac.TpLogError("Drain failed: %s - forcing exit", err.Error())
+			os.Exit(atmi.FAIL)
+		}
+
+		if err := <-errL; nil != err {
+			ac.TpLogError("Listeners drain failed: %s - forcing exit", err.Error())
+			os.Exit(atmi.FAIL)
+		}
+
+		logRateLimitStats(ac)
+		ac.TpLogWarn("Requests rejected by queue limits: %d",
+			atomic.LoadUint64(&M_queue_rejected))
+
 		//Shutdown all contexts...
-		ac.TpLogWarn("Got signal %d - shutting down all XATMI client contexts",
-			sig)
-		unInit(ac, atmi.SUCCEED)
+		ac.TpLogWarn("Drain complete - shutting down all XATMI client contexts")
+		stopAdmin()
+		stopTrace(ac)
+		closeAccessLog()
+		close(M_shutdown_done)
 	}()
 }
 
@@ -697,11 +1477,24 @@ func main() {
 		os.Exit(atmi.FAIL)
 	}
 
+	//"-openapi" prints the OpenAPI document of the configuration and exits
+	for _, arg := range os.Args[1:] {
+		if "-openapi" == arg {
+			M_openapi_cli = true
+		}
+	}
+
 	if err := appinit(M_ac); nil != err {
 		M_ac.TpLogError("Failed to init: %s", err)
 		os.Exit(atmi.FAIL)
 	}
 
+	if M_openapi_cli {
+		os.Stdout.Write(M_openapi_doc)
+		os.Stdout.WriteString("\n")
+		unInit(M_ac, atmi.SUCCEED)
+	}
+
 	handleShutdown(M_ac)
 
 	M_ac.TpLogWarn("REST Incoming init ok - serving...")
@@ -0,0 +1,193 @@
+/**
+ * @brief JSON Schema (draft 2020-12) validation of incoming requests
+ *
+ * @file schema.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+//Schema validation failure
+type SchemaViolation struct {
+	Instance string `json:"instance"` //JSON pointer in request
+	Keyword  string `json:"keyword"`  //JSON pointer in schema
+	Message  string `json:"message"`
+}
+
+//Compiled schemas by file name, shared by routes
+var M_schema_cache = make(map[string]*jsonschema.Schema)
+
+//Compile the route's request schema (if configured)
+//@param ac	ATMI Context
+//@param svc	Service map
+//@return error or nil
+func initSchema(ac *atmi.ATMICtx, svc *ServiceMap) error {
+
+	if "" == svc.Schema {
+		return nil
+	}
+
+	switch svc.Conv_int {
+	case CONV_JSON2UBF, CONV_JSON2VIEW, CONV_JSON:
+	default:
+		return fmt.Errorf("Route [%s]: 'schema' works only with 'json2ubf', "+
+			"'json2view' or 'json' conv", svc.Url)
+	}
+
+	if sch, ok := M_schema_cache[svc.Schema]; ok {
+		svc.Schema_sch = sch
+		return nil
+	}
+
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft2020
+
+	sch, err := c.Compile(svc.Schema)
+
+	if nil != err {
+		return fmt.Errorf("Route [%s]: failed to compile schema [%s]: %s",
+			svc.Url, svc.Schema, err.Error())
+	}
+
+	ac.TpLogInfo("Route [%s]: loaded request schema [%s]", svc.Url, svc.Schema)
+	M_schema_cache[svc.Schema] = sch
+	svc.Schema_sch = sch
+
+	return nil
+}
+
+//Validate request body against route's schema
+//@param ac	ATMI Context
+//@param svc	Service map
+//@param body	request body
+//@return nil or error with HTTP status 400 and the list of violations
+func validateSchema(ac *atmi.ATMICtx, svc *ServiceMap, body []byte) atmi.ATMIError {
+
+	var doc interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	if err := dec.Decode(&doc); nil != err {
+		ac.TpLogError("Invalid JSON in request: %s", err.Error())
+		herr := NewHTTPError(atmi.TPEINVAL, "Invalid JSON", http.StatusBadRequest)
+		herr.Violations = []SchemaViolation{{Message: err.Error()}}
+		return herr
+	}
+
+	err := svc.Schema_sch.Validate(doc)
+
+	if nil == err {
+		return nil
+	}
+
+	ve, ok := err.(*jsonschema.ValidationError)
+
+	if !ok {
+		ac.TpLogError("Schema validation failed: %s", err.Error())
+		return NewHTTPError(atmi.TPESYSTEM, "Schema validation failed",
+			http.StatusInternalServerError)
+	}
+
+	herr := NewHTTPError(atmi.TPEINVAL, "Request does not match schema",
+		http.StatusBadRequest)
+
+	for _, e := range ve.BasicOutput().Errors {
+
+		//Skip the summary entries ("doesn't validate with ...")
+		if strings.HasPrefix(e.Error, "doesn't validate with") {
+			continue
+		}
+
+		ac.TpLogWarn("Schema violation at [%s] (%s): %s",
+			e.InstanceLocation, e.KeywordLocation, e.Error)
+		herr.Violations = append(herr.Violations, SchemaViolation{
+			Instance: e.InstanceLocation, Keyword: e.KeywordLocation,
+			Message: e.Error})
+	}
+
+	return herr
+}
+
+//Add violations to the error response. Text errors get a line per
+//violation, otherwise "violations" array is added to the JSON object.
+//@param svc	Service map
+//@param rsp	error response generated
+//@param violations	validation failures
+//@return response
+func addViolations(svc *ServiceMap, rsp []byte,
+	violations []SchemaViolation) []byte {
+
+	if ERRORS_TEXT == svc.Errors_int {
+		var b bytes.Buffer
+
+		b.Write(rsp)
+
+		for _, v := range violations {
+			instance := v.Instance
+
+			if "" == instance {
+				instance = "/"
+			}
+
+			fmt.Fprintf(&b, "\n%s: %s", instance, v.Message)
+		}
+
+		return b.Bytes()
+	}
+
+	list, _ := json.Marshal(violations)
+	strrsp := strings.TrimSpace(string(rsp))
+
+	if i := strings.LastIndex(strrsp, "}"); i > -1 {
+
+		sep := ","
+
+		if match, _ := regexp.MatchString("^{\\s*}$", strrsp); match {
+			sep = ""
+		}
+
+		return []byte(fmt.Sprintf("%s%s\"violations\":%s}", strrsp[0:i], sep, list))
+	}
+
+	return []byte(fmt.Sprintf("{\"violations\":%s}", list))
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
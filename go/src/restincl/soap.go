@@ -0,0 +1,347 @@
+/**
+ * @brief SOAP 1.1/1.2 envelope support (soap conv)
+ *
+ * @file soap.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//SOAP versions and envelope namespaces
+const (
+	SOAP_11 = 1
+	SOAP_12 = 2
+
+	SOAP_11_NS = "http://schemas.xmlsoap.org/soap/envelope/"
+	SOAP_12_NS = "http://www.w3.org/2003/05/soap-envelope"
+)
+
+//SOAP request state, resolved for each request
+type soapRequest struct {
+	Version int    //SOAP_11 or SOAP_12
+	Action  string //SOAPAction header or "action" content type parameter
+	Op      string //First Body child element (operation)
+	Ns      string //Namespace of operation element
+}
+
+//Get SOAP version and action from the request headers. Version is later
+//confirmed by the envelope namespace.
+//@param req	HTTP Request
+//@return SOAP request state
+func newSOAPRequest(req *http.Request) *soapRequest {
+
+	sr := soapRequest{Version: SOAP_11}
+
+	mt, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+
+	if nil == err && "application/soap+xml" == mt {
+		sr.Version = SOAP_12
+		sr.Action = params["action"]
+	}
+
+	if action := req.Header.Get("SOAPAction"); "" != action {
+		sr.Action = strings.Trim(action, "\"")
+	}
+
+	return &sr
+}
+
+//Get SOAP request state of the route
+//@param svc	Service map
+//@return SOAP request state, SOAP 1.1 if not resolved
+func getSOAPRequest(svc *ServiceMap) *soapRequest {
+
+	if nil == svc.Soap_req {
+		return &soapRequest{Version: SOAP_11}
+	}
+
+	return svc.Soap_req
+}
+
+//Resolve target service by SOAP action, then by operation element name.
+//If not mapped, route's service is used.
+//@param svc	Service map
+//@param sr	SOAP request state
+//@return service name or "" if not resolved
+func soapService(svc *ServiceMap, sr *soapRequest) string {
+
+	if "" != sr.Action {
+		if s, ok := svc.Soap_svcs[sr.Action]; ok {
+			return s
+		}
+	}
+
+	if s, ok := svc.Soap_svcs[sr.Op]; ok {
+		return s
+	}
+
+	return svc.Svc
+}
+
+//Generate invalid request error
+//@param ac	ATMI Context
+//@param msg	error message
+//@return ATMI error
+func soapInvalid(ac *atmi.ATMICtx, msg string) atmi.ATMIError {
+
+	ac.TpLogError("Invalid SOAP request: %s", msg)
+	return atmi.NewCustomATMIError(atmi.TPEINVAL, msg)
+}
+
+//Unwrap SOAP envelope and load the operation element children into UBF.
+//Header entries are ignored.
+//@param ac	ATMI Context
+//@param sr	SOAP request state, operation and version are set
+//@param buf	UBF buffer
+//@param data	SOAP envelope
+//@return ATMI error or nil
+func SOAPToUBF(ac *atmi.ATMICtx, sr *soapRequest, buf *atmi.TypedUBF,
+	data []byte) atmi.ATMIError {
+
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	depth := 0
+
+	for {
+		tok, err := dec.Token()
+
+		if nil != err {
+			return soapInvalid(ac, "Failed to parse SOAP envelope: "+err.Error())
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+
+			switch depth {
+			case 1:
+				if "Envelope" != t.Name.Local {
+					return soapInvalid(ac, fmt.Sprintf("Root element [%s] "+
+						"is not SOAP Envelope", t.Name.Local))
+				}
+
+				switch t.Name.Space {
+				case SOAP_11_NS:
+					sr.Version = SOAP_11
+				case SOAP_12_NS:
+					sr.Version = SOAP_12
+				default:
+					return soapInvalid(ac, fmt.Sprintf("Unsupported SOAP "+
+						"envelope namespace [%s]", t.Name.Space))
+				}
+			case 2:
+				if "Header" == t.Name.Local {
+					if err := dec.Skip(); nil != err {
+						return soapInvalid(ac, "Failed to parse SOAP Header: "+
+							err.Error())
+					}
+					depth--
+				} else if "Body" != t.Name.Local {
+					return soapInvalid(ac, fmt.Sprintf("Unexpected element [%s] "+
+						"in SOAP Envelope", t.Name.Local))
+				}
+			case 3:
+				sr.Op = t.Name.Local
+				sr.Ns = t.Name.Space
+
+				ac.TpLogInfo("SOAP %d operation [%s] ns [%s] action [%s]",
+					sr.Version, sr.Op, sr.Ns, sr.Action)
+
+				if err := xmlDecodeFields(ac, dec, buf); nil != err {
+					return soapInvalid(ac, err.Message())
+				}
+
+				if err := xmlDecodeEnd(ac, dec); nil != err {
+					return soapInvalid(ac, err.Message())
+				}
+
+				return nil
+			}
+		case xml.EndElement:
+			//Envelope or Body closed before operation element
+			return soapInvalid(ac, "No operation element in SOAP Body")
+		}
+	}
+}
+
+//Check if error is caused by the request (Client/Sender fault)
+//@param code	ATMI error code
+//@return true if client side error
+func soapClientError(code int) bool {
+
+	switch code {
+	case atmi.TPEINVAL, atmi.TPENOENT, atmi.TPEPERM, atmi.TPEITYPE:
+		return true
+	}
+
+	return false
+}
+
+//Get HTTP status for SOAP response. Faults are returned with 500, in SOAP 1.2
+//Sender faults are returned with 400.
+//@param svc	Service map
+//@param code	ATMI error code
+//@return HTTP status code
+func soapHTTPStatus(svc *ServiceMap, code int) int {
+
+	if atmi.TPMINVAL == code {
+		return http.StatusOK
+	} else if SOAP_12 == getSOAPRequest(svc).Version && soapClientError(code) {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+//Get SOAP response content type
+//@param svc	Service map
+//@return content type
+func soapContentType(svc *ServiceMap) string {
+
+	if SOAP_12 == getSOAPRequest(svc).Version {
+		return "application/soap+xml; charset=utf-8"
+	}
+
+	return "text/xml; charset=utf-8"
+}
+
+//Write SOAP Fault start, with fault code derived from ATMI error code
+//and the error code/message in the detail
+//@param b	output buffer
+//@param sr	SOAP request state
+//@param code	ATMI error code
+//@param msg	error message
+func soapStartFault(b *bytes.Buffer, sr *soapRequest, code int, msg string) {
+
+	if SOAP_12 == sr.Version {
+		fault := "soap:Receiver"
+
+		if soapClientError(code) {
+			fault = "soap:Sender"
+		}
+
+		fmt.Fprintf(b, "<soap:Fault><soap:Code><soap:Value>%s</soap:Value>"+
+			"</soap:Code><soap:Reason><soap:Text xml:lang=\"en\">", fault)
+		xml.EscapeText(b, []byte(msg))
+		b.WriteString("</soap:Text></soap:Reason><soap:Detail>")
+	} else {
+		fault := "soap:Server"
+
+		if soapClientError(code) {
+			fault = "soap:Client"
+		}
+
+		fmt.Fprintf(b, "<soap:Fault><faultcode>%s</faultcode><faultstring>", fault)
+		xml.EscapeText(b, []byte(msg))
+		b.WriteString("</faultstring><detail>")
+	}
+
+	fmt.Fprintf(b, "<EX_IF_ECODE>%d</EX_IF_ECODE><EX_IF_EMSG>", code)
+	xml.EscapeText(b, []byte(msg))
+	b.WriteString("</EX_IF_EMSG>")
+}
+
+//Write SOAP Fault end
+//@param b	output buffer
+//@param sr	SOAP request state
+func soapEndFault(b *bytes.Buffer, sr *soapRequest) {
+
+	if SOAP_12 == sr.Version {
+		b.WriteString("</soap:Detail></soap:Fault>")
+	} else {
+		b.WriteString("</detail></soap:Fault>")
+	}
+}
+
+//Generate SOAP response envelope. On success UBF fields are returned in
+//<operation>Response element, on error in the SOAP Fault detail.
+//@param ac	ATMI Context
+//@param svc	Service map
+//@param buf	UBF buffer, may be nil
+//@param code	ATMI error code (TPMINVAL on success)
+//@param msg	error message
+//@return SOAP envelope or error
+func UBFToSOAP(ac *atmi.ATMICtx, svc *ServiceMap, buf *atmi.TypedUBF,
+	code int, msg string) (string, atmi.UBFError) {
+
+	sr := getSOAPRequest(svc)
+	ns := SOAP_11_NS
+
+	if SOAP_12 == sr.Version {
+		ns = SOAP_12_NS
+	}
+
+	var b bytes.Buffer
+
+	b.WriteString(xml.Header)
+	fmt.Fprintf(&b, "<soap:Envelope xmlns:soap=\"%s\"><soap:Body>", ns)
+
+	rspElm := sr.Op + "Response"
+
+	if atmi.TPMINVAL == code {
+		b.WriteString("<" + rspElm)
+
+		if "" != sr.Ns {
+			b.WriteString(" xmlns=\"")
+			xml.EscapeText(&b, []byte(sr.Ns))
+			b.WriteString("\"")
+		}
+
+		b.WriteString(">")
+	} else {
+		soapStartFault(&b, sr, code, msg)
+	}
+
+	if nil != buf {
+		if err := xmlWriteFields(ac, &b, buf); nil != err {
+			return "", err
+		}
+	}
+
+	if atmi.TPMINVAL == code {
+		b.WriteString("</" + rspElm + ">")
+	} else {
+		soapEndFault(&b, sr)
+	}
+
+	b.WriteString("</soap:Body></soap:Envelope>")
+
+	return b.String(), nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
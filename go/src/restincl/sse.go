@@ -0,0 +1,356 @@
+/**
+ * @brief Server-Sent Events routes (conv "sse"): events posted to Enduro/X
+ *  event broker are streamed to clients, with Last-Event-ID resume
+ *
+ * @file sse.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//SSE defaults
+const (
+	SSE_HEARTBEAT_DEFAULT = 15  //Seconds between heartbeat comments
+	SSE_BUFFER_DEFAULT    = 100 //Events kept for Last-Event-ID resume
+)
+
+//Event sent to SSE clients
+type sseEvent struct {
+	id   int64
+	data []byte
+}
+
+//Route's event subscription shared by the connected clients. Recent events
+//are kept in bounded buffer, so that reconnecting client can resume from
+//its Last-Event-ID.
+type sseHub struct {
+	s       *streamSession
+	mu      sync.Mutex
+	seq     int64                  //Last event id
+	buf     []sseEvent             //Recent events, oldest first
+	size    int                    //Max events in buf
+	clients map[chan sseEvent]bool //Connected clients
+}
+
+var M_sse_hubs = make(map[string]*sseHub) //Route -> hub
+var M_sse_hubs_mutex sync.Mutex
+
+//Validate SSE route settings
+//@param svc	Service map
+//@return error or nil
+func initSSE(svc *ServiceMap) error {
+
+	if CONV_SSE != svc.Conv_int {
+		return nil
+	}
+
+	if "" == svc.Ev_mask {
+		return fmt.Errorf("Route [%s]: 'sse' conv needs 'ev_mask'", svc.Url)
+	}
+
+	if svc.Sse_heartbeat < 0 || svc.Sse_buffer < 0 {
+		return fmt.Errorf("Route [%s]: invalid 'sse_heartbeat' or 'sse_buffer'",
+			svc.Url)
+	}
+
+	return nil
+}
+
+//Get the route's hub, subscribe to events on first use. Hub stays
+//subscribed until shutdown, so that events are buffered for resume.
+//@param svc	Service map
+//@return hub or error
+func getSSEHub(svc *ServiceMap) (*sseHub, atmi.ATMIError) {
+
+	key := svc.Url + "\n" + svc.Ev_mask + "\n" + svc.Ev_filter
+
+	M_sse_hubs_mutex.Lock()
+	defer M_sse_hubs_mutex.Unlock()
+
+	if h, ok := M_sse_hubs[key]; ok {
+		return h, nil
+	}
+
+	s, err := openStream(svc)
+
+	if nil != err {
+		return nil, err
+	}
+
+	h := &sseHub{s: s, size: svc.Sse_buffer,
+		clients: make(map[chan sseEvent]bool)}
+	M_sse_hubs[key] = h
+
+	go s.pollEvents(M_streams_stop)
+	go h.run()
+
+	return h, nil
+}
+
+//Dispatch the events to clients until shutdown
+func (h *sseHub) run() {
+
+	for {
+		select {
+		case <-M_streams_stop:
+			h.mu.Lock()
+			for c := range h.clients {
+				delete(h.clients, c)
+				close(c)
+			}
+			h.mu.Unlock()
+			h.s.close()
+			return
+		case data := <-h.s.events:
+			h.publish(data)
+		}
+	}
+}
+
+//Number the event, buffer it and send to clients. Clients which do not
+//keep up are disconnected, they may resume with Last-Event-ID.
+//@param data	event buffer JSON
+func (h *sseHub) publish(data []byte) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	ev := sseEvent{id: h.seq, data: data}
+
+	if h.size > 0 {
+		if len(h.buf) >= h.size {
+			h.buf = append(h.buf[:0], h.buf[len(h.buf)-h.size+1:]...)
+		}
+		h.buf = append(h.buf, ev)
+	}
+
+	for c := range h.clients {
+		select {
+		case c <- ev:
+		default:
+			M_ac.TpLogWarn("SSE client does not keep up - disconnecting")
+			delete(h.clients, c)
+			close(c)
+		}
+	}
+}
+
+//Register client
+//@param lastId	Last-Event-ID header value, empty if not resuming
+//@return client channel and buffered events to replay
+func (h *sseHub) join(lastId string) (chan sseEvent, []sseEvent) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := make(chan sseEvent, STREAM_EVENTS_QUEUE)
+	h.clients[c] = true
+
+	if "" == lastId {
+		return c, nil
+	}
+
+	id, err := strconv.ParseInt(strings.TrimSpace(lastId), 10, 64)
+
+	//Ids from earlier process run are not known
+	if nil != err || id > h.seq {
+		M_ac.TpLogWarn("Unknown Last-Event-ID [%s] - not resumed", lastId)
+		return c, nil
+	}
+
+	var replay []sseEvent
+
+	for _, ev := range h.buf {
+		if ev.id > id {
+			replay = append(replay, ev)
+		}
+	}
+
+	if len(h.buf) > 0 && h.buf[0].id > id+1 {
+		M_ac.TpLogWarn("Last-Event-ID %d is out of buffer, events %d..%d lost",
+			id, id+1, h.buf[0].id-1)
+	}
+
+	return c, replay
+}
+
+//Unregister client
+//@param c	client channel
+func (h *sseHub) leave(c chan sseEvent) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c)
+	}
+}
+
+//Write event in SSE format, each data line is prefixed
+//@param w	Response writer
+//@param ev	event
+//@return write error
+func writeSSEEvent(w http.ResponseWriter, ev sseEvent) error {
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "id: %d\n", ev.id)
+
+	for _, line := range strings.Split(string(ev.data), "\n") {
+		fmt.Fprintf(&b, "data: %s\n", strings.TrimRight(line, "\r"))
+	}
+
+	b.WriteString("\n")
+
+	_, err := w.Write([]byte(b.String()))
+
+	return err
+}
+
+//Extend the write deadline of the stream, so that write_timeout limits each
+//write instead of the whole stream
+//@param rc	Response controller
+func extendWriteDeadline(rc *http.ResponseController) {
+
+	if M_write_timeout <= 0 {
+		return
+	}
+
+	if err := rc.SetWriteDeadline(time.Now().Add(
+		time.Duration(M_write_timeout) * time.Second)); nil != err {
+		M_ac.TpLogDebug("Failed to set write deadline: %s", err.Error())
+	}
+}
+
+//Serve SSE route: authenticate, replay buffered events after Last-Event-ID
+//and stream new events with heartbeat comments until client disconnects
+//@param svc	Service map
+//@param w	Response writer
+//@param req	HTTP Request
+func serveSSE(svc *ServiceMap, w http.ResponseWriter, req *http.Request) {
+
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		M_ac.TpLogError("URL [%s] streaming not supported by connection", req.URL)
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	if !streamAccept(svc, w, req, make(map[string][]string)) {
+		return
+	}
+
+	if err := acquireStream(); nil != err {
+		rejectRequest(svc, w, err)
+		return
+	}
+
+	defer releaseStream()
+
+	h, err := getSSEHub(svc)
+
+	if nil != err {
+		rejectRequest(svc, w, err)
+		return
+	}
+
+	c, replay := h.join(req.Header.Get("Last-Event-ID"))
+	defer h.leave(c)
+
+	M_ac.TpLogInfo("URL [%s] SSE client connected: %s, replaying %d events",
+		req.URL, req.RemoteAddr, len(replay))
+
+	rc := http.NewResponseController(w)
+	extendWriteDeadline(rc)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for _, ev := range replay {
+		if nil != writeSSEEvent(w, ev) {
+			return
+		}
+	}
+
+	flusher.Flush()
+
+	var heartbeat <-chan time.Time
+
+	if svc.Sse_heartbeat > 0 {
+		ticker := time.NewTicker(time.Duration(svc.Sse_heartbeat) * time.Second)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	for {
+		select {
+		case <-req.Context().Done():
+			M_ac.TpLogInfo("URL [%s] SSE client disconnected: %s",
+				req.URL, req.RemoteAddr)
+			return
+		case <-M_streams_stop:
+			return
+		case <-heartbeat:
+			extendWriteDeadline(rc)
+
+			if _, err := w.Write([]byte(": heartbeat\n\n")); nil != err {
+				return
+			}
+		case ev, ok := <-c:
+			if !ok {
+				return
+			}
+
+			extendWriteDeadline(rc)
+
+			if nil != writeSSEEvent(w, ev) {
+				return
+			}
+		}
+
+		flusher.Flush()
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,201 @@
+/**
+ * @brief Static file routes (conv "static"), with index fallback for
+ *  single-page applications
+ *
+ * @file static.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//Static route defaults
+const (
+	STATIC_INDEX_DEFAULT = "index.html"
+)
+
+//Validate static route settings
+//@param svc	Service map
+//@return error or nil
+func initStatic(svc *ServiceMap) error {
+
+	if CONV_STATIC != svc.Conv_int {
+		return nil
+	}
+
+	if isRegexpFormat(svc) {
+		return fmt.Errorf("Route [%s]: 'static' conv works only with plain "+
+			"URL (directory prefix)", svc.Url)
+	}
+
+	if "" == svc.Static_dir {
+		return fmt.Errorf("Route [%s]: 'static' conv needs 'static_dir'", svc.Url)
+	}
+
+	if fi, err := os.Stat(svc.Static_dir); nil != err || !fi.IsDir() {
+		return fmt.Errorf("Route [%s]: invalid 'static_dir' [%s]", svc.Url,
+			svc.Static_dir)
+	}
+
+	if "" == svc.Static_index {
+		svc.Static_index = STATIC_INDEX_DEFAULT
+	}
+
+	if svc.Static_max_age < 0 {
+		return fmt.Errorf("Route [%s]: invalid 'static_max_age'", svc.Url)
+	}
+
+	return nil
+}
+
+//Register static route. Routes are matched by URL prefix, after the
+//service routes, longest prefix first.
+//@param svc	Service map
+//@param handler	route handler
+func (h *RegexpHandler) handleStatic(svc ServiceMap, handler http.Handler) {
+
+	prefix := strings.TrimSuffix(svc.Url, "/")
+	pattern := regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + "(/|$)")
+
+	h.staticRoutes = append(h.staticRoutes, &route{pattern, handler})
+
+	sort.SliceStable(h.staticRoutes, func(i, j int) bool {
+		return len(h.staticRoutes[i].pattern.String()) >
+			len(h.staticRoutes[j].pattern.String())
+	})
+}
+
+//Resolve file for the request path
+//@param svc	Service map
+//@param reqPath	URL path
+//@return file path or "" if not found (or not allowed)
+func staticFile(svc *ServiceMap, reqPath string) string {
+
+	rel := path.Clean("/" + strings.TrimPrefix(reqPath,
+		strings.TrimSuffix(svc.Url, "/")))
+
+	//Hidden files (.git, .htpasswd, ...) are not served
+	for _, elem := range strings.Split(rel, "/") {
+		if strings.HasPrefix(elem, ".") {
+			return ""
+		}
+	}
+
+	file := filepath.Join(svc.Static_dir, filepath.FromSlash(rel))
+	fi, err := os.Stat(file)
+
+	if nil != err {
+		return ""
+	}
+
+	if fi.IsDir() {
+		file = filepath.Join(file, svc.Static_index)
+
+		if fi, err = os.Stat(file); nil != err || fi.IsDir() {
+			return ""
+		}
+	}
+
+	return file
+}
+
+//Serve static route: file from static_dir, directory index or (for single
+//page apps) the root index. Conditional and range requests are handled by
+//http.ServeContent, ETag is built from file modification time and size.
+//@param svc	Service map
+//@param w	Response writer
+//@param req	HTTP Request
+func serveStatic(svc *ServiceMap, w http.ResponseWriter, req *http.Request) {
+
+	if http.MethodGet != req.Method && http.MethodHead != req.Method {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	file := staticFile(svc, req.URL.Path)
+
+	//Client side routes of single page app get the app
+	if "" == file && svc.Static_spa && "" == path.Ext(req.URL.Path) {
+		file = staticFile(svc, "/")
+	}
+
+	if "" == file {
+		M_ac.TpLogInfo("URL [%s] static file not found", req.URL)
+		http.NotFound(w, req)
+		return
+	}
+
+	f, err := os.Open(file)
+
+	if nil != err {
+		M_ac.TpLogError("URL [%s] failed to open [%s]: %s", req.URL, file,
+			err.Error())
+		http.NotFound(w, req)
+		return
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+
+	if nil != err {
+		M_ac.TpLogError("URL [%s] failed to stat [%s]: %s", req.URL, file,
+			err.Error())
+		http.NotFound(w, req)
+		return
+	}
+
+	//Index must be revalidated, so that new app version is picked up
+	if svc.Static_max_age > 0 && filepath.Base(file) != svc.Static_index {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d",
+			svc.Static_max_age))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", fi.ModTime().UnixNano(),
+		fi.Size()))
+
+	M_ac.TpLogDebug("URL [%s] serving [%s]", req.URL, file)
+
+	http.ServeContent(w, req, fi.Name(), fi.ModTime(), f)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,332 @@
+/**
+ * @brief Streaming connections (WebSocket, SSE) with own XATMI context and
+ *  event broker subscriptions
+ *
+ * @file stream.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Defaults
+const (
+	STREAM_MAX_DEFAULT   = 100 //Max concurrent streaming connections
+	STREAM_EVENTS_QUEUE  = 100 //Events waiting for delivery per connection
+	STREAM_POLL_INTERVAL = 100 * time.Millisecond
+)
+
+var M_stream_max int              //Max concurrent streaming connections
+var M_streams int32               //Current streaming connections
+var M_streams_stop chan bool      //Closed on shutdown, streams terminate
+var M_streams_stop_once sync.Once //Guard for closing above
+
+//Streaming connection session. Each session has own XATMI context, so that
+//events subscribed by route's ev_mask/ev_filter are delivered to it as
+//unsolicited messages. Context is used by connection's goroutines, thus
+//access is serialized.
+type streamSession struct {
+	ac     *atmi.ATMICtx
+	mu     sync.Mutex
+	subs   int64       //Subscription id, atmi.FAIL if not subscribed
+	closed bool        //Context is released
+	events chan []byte //Events converted to JSON
+}
+
+//Convert XATMI buffer to JSON. UBF, VIEW and JSON buffers are converted
+//to objects, STRING to JSON string and CARRAY to base64 string.
+//@param ac	ATMI Context
+//@param buf	XATMI buffer
+//@return JSON or error
+func bufferToJSON(ac *atmi.ATMICtx, buf atmi.TypedBuffer) ([]byte, atmi.ATMIError) {
+
+	var itype, subtype string
+
+	if _, err := ac.TpTypes(buf.GetBuf(), &itype, &subtype); nil != err {
+		return nil, err
+	}
+
+	switch itype {
+	case "UBF", "UBF32", "FML", "FML32":
+		u, err := ac.CastToUBF(buf.GetBuf())
+
+		if nil != err {
+			return nil, err
+		}
+
+		ret, errU := u.TpUBFToJSON()
+
+		if nil != errU {
+			return nil, errU
+		}
+
+		return []byte(ret), nil
+	case "VIEW", "VIEW32":
+		v, err := ac.CastToVIEW(buf.GetBuf())
+
+		if nil != err {
+			return nil, err
+		}
+
+		ret, errU := v.TpVIEWToJSON(0)
+
+		if nil != errU {
+			return nil, errU
+		}
+
+		return []byte(ret), nil
+	case "JSON":
+		j, err := ac.CastToJSON(buf.GetBuf())
+
+		if nil != err {
+			return nil, err
+		}
+
+		return j.GetJSON(), nil
+	case "STRING":
+		s, err := ac.CastToString(buf.GetBuf())
+
+		if nil != err {
+			return nil, err
+		}
+
+		ret, _ := json.Marshal(s.GetString())
+
+		return ret, nil
+	case "CARRAY":
+		c, err := ac.CastToCarray(buf.GetBuf())
+
+		if nil != err {
+			return nil, err
+		}
+
+		ret, _ := json.Marshal(c.GetBytes())
+
+		return ret, nil
+	}
+
+	return []byte("null"), nil
+}
+
+//Authorize the streaming request (auth service) and collect the fields to
+//install in each request buffer. Worker context is used for the time of the
+//auth service call. In case of failure, error response is sent.
+//@param svc	Service map
+//@param w	Response writer
+//@param req	HTTP Request
+//@param fields	additional request fields, filled here
+//@return true if request is accepted
+func streamAccept(svc *ServiceMap, w http.ResponseWriter, req *http.Request,
+	fields map[string][]string) bool {
+
+	//Local auth is already done, context is needed for auth service only
+	if "" != svc.Authsvc {
+		nr, ok := getFreeContext(svc, w, req)
+
+		if !ok {
+			return false
+		}
+
+		defer func() { M_freechan <- nr }()
+
+		ac := M_ctxs[nr]
+
+		if err := callAuthSvc(ac, svc, w, req, fields); nil != err {
+			genRsp(ac, nil, svc, w, err, false)
+			return false
+		}
+	}
+
+	getPathParams(svc, req, fields)
+	getTLSClientFields(M_ac, svc, req, fields)
+	getAuthFields(svc, svc.Auth_res, fields)
+
+	return true
+}
+
+//Reserve streaming connection slot (see stream_max)
+//@return nil or TPELIMIT error
+func acquireStream() atmi.ATMIError {
+
+	if n := atomic.AddInt32(&M_streams, 1); M_stream_max > 0 &&
+		int(n) > M_stream_max {
+		atomic.AddInt32(&M_streams, -1)
+		M_ac.TpLogWarn("Max streaming connections (%d) reached", M_stream_max)
+		return NewHTTPError(atmi.TPELIMIT, "Too many streaming connections",
+			http.StatusServiceUnavailable)
+	}
+
+	return nil
+}
+
+//Release streaming connection slot
+func releaseStream() {
+	atomic.AddInt32(&M_streams, -1)
+}
+
+//Open streaming session: allocate XATMI context and subscribe to events
+//if route has ev_mask set
+//@param svc	Service map
+//@return session or error
+func openStream(svc *ServiceMap) (*streamSession, atmi.ATMIError) {
+
+	if err := acquireStream(); nil != err {
+		return nil, err
+	}
+
+	ac, err := atmi.NewATMICtx()
+
+	if nil != err {
+		releaseStream()
+		M_ac.TpLogError("Failed to create stream context: %s", err.Message())
+		return nil, err
+	}
+
+	s := &streamSession{ac: ac, subs: atmi.FAIL,
+		events: make(chan []byte, STREAM_EVENTS_QUEUE)}
+
+	if err = ac.TpInit(); nil != err {
+		ac.TpLogError("Failed to init stream context: %s", err.Message())
+		s.close()
+		return nil, err
+	}
+
+	if "" == svc.Ev_mask {
+		return s, nil
+	}
+
+	//Events are posted to client as unsolicited messages
+	if err = ac.TpSetUnsol(func(uac *atmi.ATMICtx, buf atmi.TypedBuffer) {
+
+		data, errC := bufferToJSON(uac, buf)
+
+		if nil != errC {
+			uac.TpLogError("Failed to convert event to JSON: %s", errC.Message())
+			return
+		}
+
+		select {
+		case s.events <- data:
+		default:
+			uac.TpLogWarn("Event queue full - event dropped")
+		}
+	}); nil != err {
+		ac.TpLogError("Failed to set unsolicited handler: %s", err.Message())
+		s.close()
+		return nil, err
+	}
+
+	if s.subs, err = ac.TpSubscribe(svc.Ev_mask, svc.Ev_filter, nil, 0); nil != err {
+		ac.TpLogError("Failed to subscribe to [%s] filter [%s]: %s",
+			svc.Ev_mask, svc.Ev_filter, err.Message())
+		s.subs = atmi.FAIL
+		s.close()
+		return nil, err
+	}
+
+	ac.TpLogInfo("Subscribed to events [%s] filter [%s], id %d",
+		svc.Ev_mask, svc.Ev_filter, s.subs)
+
+	return s, nil
+}
+
+//Deliver pending events to the events channel. Run periodically while the
+//session has subscription.
+func (s *streamSession) poll() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	if _, err := s.ac.TpChkUnsol(); nil != err {
+		s.ac.TpLogError("Failed to check unsolicited messages: %s", err.Message())
+	}
+}
+
+//Run events polling until done is closed
+//@param done	closed when session terminates
+func (s *streamSession) pollEvents(done chan bool) {
+
+	if atmi.FAIL == s.subs {
+		return
+	}
+
+	ticker := time.NewTicker(STREAM_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.poll()
+		}
+	}
+}
+
+//Unsubscribe and release the session context. May be called more than once.
+func (s *streamSession) close() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	if atmi.FAIL != s.subs {
+		if _, err := s.ac.TpUnsubscribe(s.subs, 0); nil != err {
+			s.ac.TpLogError("Failed to unsubscribe %d: %s", s.subs, err.Message())
+		}
+		s.subs = atmi.FAIL
+	}
+
+	s.ac.TpTerm()
+	s.ac.FreeATMICtx()
+	s.closed = true
+	releaseStream()
+}
+
+//Terminate all streaming connections (server shutdown)
+func stopStreams() {
+	M_streams_stop_once.Do(func() { close(M_streams_stop) })
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,266 @@
+/**
+ * @brief TLS settings: client certificate verification (mutual TLS),
+ *  protocol versions, cipher suites and client identity forwarding
+ *
+ * @file tlssupp.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Client certificate attributes which can be forwarded to service
+const (
+	TLS_ATTR_SUBJECT     = "subject"
+	TLS_ATTR_ISSUER      = "issuer"
+	TLS_ATTR_SAN         = "san"
+	TLS_ATTR_SERIAL      = "serial"
+	TLS_ATTR_FINGERPRINT = "fingerprint"
+)
+
+//TLS settings of the listener
+type tlsSettings struct {
+	Tls_enable      bool   `json:"tls_enable"`
+	Tls_cert_file   string `json:"tls_cert_file"`
+	Tls_key_file    string `json:"tls_key_file"`
+	Tls_ca_file     string `json:"tls_ca_file"`
+	Tls_client_auth string `json:"tls_client_auth"`
+	Tls_min_version string `json:"tls_min_version"`
+	Tls_ciphers     string `json:"tls_ciphers"`
+}
+
+/* mTLS Settings: */
+var M_tls_ca_file string
+var M_tls_client_auth string
+var M_tls_min_version string
+var M_tls_ciphers string
+
+//Client auth modes
+var M_tls_client_auths = map[string]tls.ClientAuthType{
+	"":         tls.NoClientCert,
+	"none":     tls.NoClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"required": tls.RequireAndVerifyClientCert,
+}
+
+//Protocol versions
+var M_tls_versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//Build TLS configuration from the settings
+//@param ac	ATMI Context
+//@param t	listener's TLS settings
+//@return TLS config or error
+func getTLSConfig(ac *atmi.ATMICtx, t *tlsSettings) (*tls.Config, error) {
+
+	cfg := &tls.Config{}
+
+	auth, ok := M_tls_client_auths[t.Tls_client_auth]
+
+	if !ok {
+		return nil, fmt.Errorf("Invalid tls_client_auth [%s], expected "+
+			"none, optional or required", t.Tls_client_auth)
+	}
+
+	cfg.ClientAuth = auth
+
+	if tls.NoClientCert != auth {
+
+		if "" == t.Tls_ca_file {
+			return nil, fmt.Errorf("tls_client_auth [%s] requires tls_ca_file",
+				t.Tls_client_auth)
+		}
+
+		pem, err := ioutil.ReadFile(t.Tls_ca_file)
+
+		if nil != err {
+			return nil, fmt.Errorf("Failed to read tls_ca_file [%s]: %s",
+				t.Tls_ca_file, err.Error())
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates loaded from tls_ca_file [%s]",
+				t.Tls_ca_file)
+		}
+
+		cfg.ClientCAs = pool
+		ac.TpLogInfo("Client certificates verified against [%s], mode: %s",
+			t.Tls_ca_file, t.Tls_client_auth)
+	}
+
+	if "" != t.Tls_min_version {
+
+		ver, ok := M_tls_versions[t.Tls_min_version]
+
+		if !ok {
+			return nil, fmt.Errorf("Invalid tls_min_version [%s], expected "+
+				"1.0, 1.1, 1.2 or 1.3", t.Tls_min_version)
+		}
+
+		cfg.MinVersion = ver
+	}
+
+	if "" != t.Tls_ciphers {
+
+		known := make(map[string]uint16)
+
+		for _, cs := range tls.CipherSuites() {
+			known[cs.Name] = cs.ID
+		}
+
+		for _, name := range regexp.MustCompile(", *").Split(t.Tls_ciphers, -1) {
+
+			id, ok := known[name]
+
+			if !ok {
+				return nil, fmt.Errorf("Unsupported cipher suite [%s]", name)
+			}
+
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+
+		ac.TpLogInfo("Cipher suites restricted to: %s", t.Tls_ciphers)
+	}
+
+	return cfg, nil
+}
+
+//Validate the client certificate field mapping of the route
+//@param svc	Service map
+//@return error or nil
+func validateTLSClientFields(svc *ServiceMap) error {
+
+	for attr := range svc.Tls_client_fields {
+		switch attr {
+		case TLS_ATTR_SUBJECT, TLS_ATTR_ISSUER, TLS_ATTR_SAN,
+			TLS_ATTR_SERIAL, TLS_ATTR_FINGERPRINT:
+			break
+		default:
+			return fmt.Errorf("Route [%s]: unsupported tls_client_fields "+
+				"attribute [%s]", svc.Url, attr)
+		}
+	}
+
+	return nil
+}
+
+//Get subject alternative names of the certificate
+//@param cert	Certificate
+//@return list of SANs in "TYPE:value" format
+func getCertSANs(cert *x509.Certificate) []string {
+
+	ret := []string{}
+
+	for _, v := range cert.DNSNames {
+		ret = append(ret, "DNS:"+v)
+	}
+
+	for _, v := range cert.EmailAddresses {
+		ret = append(ret, "email:"+v)
+	}
+
+	for _, v := range cert.IPAddresses {
+		ret = append(ret, "IP:"+v.String())
+	}
+
+	for _, v := range cert.URIs {
+		ret = append(ret, "URI:"+v.String())
+	}
+
+	return ret
+}
+
+//Add the verified client certificate attributes to request fields. Without
+//verified certificate the fields are cleared, so that client cannot set them.
+//@param ac	ATMI Context
+//@param svc	Service map
+//@param req	HTTP Request
+//@param fields	target field/key names to values, attributes are added here
+func getTLSClientFields(ac *atmi.ATMICtx, svc *ServiceMap, req *http.Request,
+	fields map[string][]string) {
+
+	if 0 == len(svc.Tls_client_fields) {
+		return
+	}
+
+	if nil == req.TLS || 0 == len(req.TLS.VerifiedChains) ||
+		0 == len(req.TLS.VerifiedChains[0]) {
+
+		for _, fld := range svc.Tls_client_fields {
+			fields[fld] = nil
+		}
+
+		return
+	}
+
+	cert := req.TLS.VerifiedChains[0][0]
+
+	ac.TpLogInfo("Client certificate: [%s]", cert.Subject.String())
+
+	for attr, fld := range svc.Tls_client_fields {
+
+		var vals []string
+
+		switch attr {
+		case TLS_ATTR_SUBJECT:
+			vals = []string{cert.Subject.String()}
+		case TLS_ATTR_ISSUER:
+			vals = []string{cert.Issuer.String()}
+		case TLS_ATTR_SAN:
+			vals = getCertSANs(cert)
+		case TLS_ATTR_SERIAL:
+			vals = []string{strings.ToUpper(cert.SerialNumber.Text(16))}
+		case TLS_ATTR_FINGERPRINT:
+			sum := sha256.Sum256(cert.Raw)
+			vals = []string{hex.EncodeToString(sum[:])}
+		}
+
+		fields[fld] = vals
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,472 @@
+/**
+ * @brief Distributed tracing: W3C traceparent/tracestate propagation to
+ *  XATMI calls and span export in OTLP/JSON (file or HTTP collector)
+ *
+ * @file trace.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Tracing defaults
+const (
+	TRACE_SERVICE_DEFAULT = "restincl"
+	TRACE_EXPORT_FILE     = "file"
+	TRACE_EXPORT_HTTP     = "http"
+	TRACE_QUEUE           = 1000            //Spans waiting for export
+	TRACE_BATCH           = 100             //Max spans per export
+	TRACE_FLUSH_INTERVAL  = 1 * time.Second //Export interval
+	TRACE_HTTP_TIMEOUT    = 5 * time.Second //Collector call time-out
+
+	SPAN_KIND_SERVER  = 2 //OTLP span kind
+	SPAN_STATUS_OK    = 1 //OTLP status codes
+	SPAN_STATUS_ERROR = 2
+)
+
+var M_trace int16 = FALSE   //Tracing enabled
+var M_trace_exporter string //"file", "http" or empty (propagation only)
+var M_trace_file string     //OTLP/JSON lines output file
+var M_trace_endpoint string //OTLP/HTTP traces URL
+var M_trace_service string  //service.name resource attribute
+
+var M_trace_spans chan *traceSpan //Spans to export, nil if not exported
+var M_trace_done chan bool        //Closed when exporter has flushed
+var M_trace_dropped uint64        //Spans dropped (queue full)
+var M_trace_mutex sync.Mutex      //Guard for the queue and counter
+
+//traceparent header: version-traceid-parentid-flags
+var M_traceparent_re = regexp.MustCompile("^([0-9a-f]{2})-([0-9a-f]{32})-" +
+	"([0-9a-f]{16})-([0-9a-f]{2})$")
+
+//Request span
+type traceSpan struct {
+	traceId    string
+	spanId     string
+	parentId   string //Empty if trace is started here
+	flags      byte
+	traceState string
+	name       string
+	start      time.Time
+	end        time.Time
+	attrs      []map[string]interface{}
+	atmiCode   int
+	atmiMsg    string
+	status     int //HTTP status
+}
+
+//Generate random id
+//@param n	number of bytes
+//@return hex id
+func traceRandomId(n int) string {
+
+	b := make([]byte, n)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+//Check that id is not all zeros (invalid in W3C Trace Context)
+//@param id	hex id
+//@return true if valid
+func traceIdValid(id string) bool {
+
+	for _, c := range id {
+		if '0' != c {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Start request span. Trace is continued from traceparent header (if valid),
+//otherwise new trace is started. Span's traceparent (and tracestate) are set
+//in the response headers.
+//@param svc	Service map
+//@param w	Response writer
+//@param req	HTTP Request
+//@return span or nil if tracing is disabled
+func startTrace(svc *ServiceMap, w http.ResponseWriter, req *http.Request) *traceSpan {
+
+	if TRUE != M_trace {
+		return nil
+	}
+
+	s := &traceSpan{spanId: traceRandomId(8), start: time.Now(),
+		name: req.Method + " " + svc.Url}
+
+	m := M_traceparent_re.FindStringSubmatch(req.Header.Get("traceparent"))
+
+	if nil != m && "ff" != m[1] && traceIdValid(m[2]) && traceIdValid(m[3]) {
+		flags, _ := strconv.ParseUint(m[4], 16, 8)
+		s.traceId = m[2]
+		s.parentId = m[3]
+		s.flags = byte(flags)
+		s.traceState = req.Header.Get("tracestate")
+	} else {
+		s.traceId = traceRandomId(16)
+		s.flags = 1 //Sampled
+	}
+
+	w.Header().Set("traceparent", s.traceparent())
+
+	if "" != s.traceState {
+		w.Header().Set("tracestate", s.traceState)
+	}
+
+	return s
+}
+
+//Span's traceparent
+//@return header value
+func (s *traceSpan) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", s.traceId, s.spanId, s.flags)
+}
+
+//Record ATMI result of the request
+//@param code	ATMI error code (TPMINVAL on success)
+//@param msg	error message
+func (s *traceSpan) setResult(code int, msg string) {
+
+	if nil == s {
+		return
+	}
+
+	s.atmiCode = code
+	s.atmiMsg = msg
+}
+
+//Add trace id and traceparent to request fields. Without trace the fields
+//are cleared, so that client cannot set them.
+//@param svc	Service map
+//@param fields	target field/key names to values
+func getTraceFields(svc *ServiceMap, fields map[string][]string) {
+
+	if "" != svc.Trace_field {
+		fields[svc.Trace_field] = nil
+
+		if nil != svc.Trace {
+			fields[svc.Trace_field] = []string{svc.Trace.traceId}
+		}
+	}
+
+	if "" != svc.Traceparent_field {
+		fields[svc.Traceparent_field] = nil
+
+		if nil != svc.Trace {
+			fields[svc.Traceparent_field] = []string{svc.Trace.traceparent()}
+		}
+	}
+}
+
+//OTLP attribute
+//@param key	attribute name
+//@param val	string or int value
+//@return attribute
+func traceAttr(key string, val interface{}) map[string]interface{} {
+
+	var v map[string]interface{}
+
+	switch t := val.(type) {
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(t)}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(t)}
+	}
+
+	return map[string]interface{}{"key": key, "value": v}
+}
+
+//Complete the span and queue it for export (if sampled)
+//@param svc	Service map
+//@param req	HTTP Request
+//@param status	HTTP response status
+func endTrace(svc *ServiceMap, req *http.Request, status int) {
+
+	s := svc.Trace
+
+	if nil == s {
+		return
+	}
+
+	s.end = time.Now()
+
+	if 0 == status {
+		status = http.StatusOK
+	}
+
+	s.status = status
+
+	if 0 == s.flags&1 || "" == M_trace_exporter {
+		return
+	}
+
+	s.attrs = append(s.attrs,
+		traceAttr("http.request.method", req.Method),
+		traceAttr("url.path", req.URL.Path),
+		traceAttr("http.route", svc.Url),
+		traceAttr("http.response.status_code", status),
+		traceAttr("client.address", req.RemoteAddr))
+
+	if "" != svc.Svc {
+		s.attrs = append(s.attrs, traceAttr("xatmi.service", svc.Svc))
+	}
+
+	if 0 != s.atmiCode {
+		s.attrs = append(s.attrs, traceAttr("xatmi.error_code", s.atmiCode),
+			traceAttr("xatmi.error_message", s.atmiMsg))
+	}
+
+	M_trace_mutex.Lock()
+	defer M_trace_mutex.Unlock()
+
+	if nil == M_trace_spans {
+		return
+	}
+
+	select {
+	case M_trace_spans <- s:
+	default:
+		M_trace_dropped++
+	}
+}
+
+//OTLP/JSON span
+//@return span object
+func (s *traceSpan) otlp() map[string]interface{} {
+
+	status := map[string]interface{}{"code": SPAN_STATUS_OK}
+
+	if 0 != s.atmiCode || s.status >= http.StatusInternalServerError {
+		status = map[string]interface{}{"code": SPAN_STATUS_ERROR,
+			"message": s.atmiMsg}
+	}
+
+	ret := map[string]interface{}{
+		"traceId":           s.traceId,
+		"spanId":            s.spanId,
+		"name":              s.name,
+		"kind":              SPAN_KIND_SERVER,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        s.attrs,
+		"status":            status,
+	}
+
+	if "" != s.parentId {
+		ret["parentSpanId"] = s.parentId
+	}
+
+	if "" != s.traceState {
+		ret["traceState"] = s.traceState
+	}
+
+	return ret
+}
+
+//Build OTLP/JSON export request
+//@param spans	spans to export
+//@return JSON document
+func traceExportDoc(spans []*traceSpan) []byte {
+
+	list := make([]interface{}, 0, len(spans))
+
+	for _, s := range spans {
+		list = append(list, s.otlp())
+	}
+
+	doc := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": []interface{}{
+				traceAttr("service.name", M_trace_service)}},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": TRACE_SERVICE_DEFAULT},
+				"spans": list}},
+		}},
+	}
+
+	ret, _ := json.Marshal(doc)
+
+	return ret
+}
+
+//Export the spans to file (line per export) or collector
+//@param spans	spans to export
+func traceExport(spans []*traceSpan) {
+
+	doc := traceExportDoc(spans)
+
+	switch M_trace_exporter {
+	case TRACE_EXPORT_FILE:
+		f, err := os.OpenFile(M_trace_file, os.O_CREATE|os.O_WRONLY|os.O_APPEND,
+			0644)
+
+		if nil != err {
+			M_ac.TpLogError("Failed to open trace file [%s]: %s", M_trace_file,
+				err.Error())
+			return
+		}
+
+		defer f.Close()
+
+		if _, err = f.Write(append(doc, '\n')); nil != err {
+			M_ac.TpLogError("Failed to write trace file [%s]: %s", M_trace_file,
+				err.Error())
+		}
+	case TRACE_EXPORT_HTTP:
+		client := http.Client{Timeout: TRACE_HTTP_TIMEOUT}
+		rsp, err := client.Post(M_trace_endpoint, "application/json",
+			bytes.NewReader(doc))
+
+		if nil != err {
+			M_ac.TpLogError("Failed to export %d spans to [%s]: %s", len(spans),
+				M_trace_endpoint, err.Error())
+			return
+		}
+
+		rsp.Body.Close()
+
+		if rsp.StatusCode >= 300 {
+			M_ac.TpLogError("Failed to export %d spans to [%s]: HTTP %d",
+				len(spans), M_trace_endpoint, rsp.StatusCode)
+		}
+	}
+}
+
+//Exporter: batch the spans, export periodically until queue is closed
+//@param spans	export queue
+func traceExporter(spans chan *traceSpan) {
+
+	var batch []*traceSpan
+
+	ticker := time.NewTicker(TRACE_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	defer close(M_trace_done)
+
+	for {
+		select {
+		case s, ok := <-spans:
+			if !ok {
+				if len(batch) > 0 {
+					traceExport(batch)
+				}
+				return
+			}
+
+			if batch = append(batch, s); len(batch) >= TRACE_BATCH {
+				traceExport(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				traceExport(batch)
+				batch = nil
+			}
+		}
+	}
+}
+
+//Validate tracing settings and start the exporter
+//@param ac	ATMI Context
+//@return error or nil
+func initTrace(ac *atmi.ATMICtx) error {
+
+	if TRUE != M_trace {
+		return nil
+	}
+
+	if "" == M_trace_service {
+		M_trace_service = TRACE_SERVICE_DEFAULT
+	}
+
+	switch M_trace_exporter {
+	case "":
+		ac.TpLogInfo("Tracing enabled, spans are not exported")
+		return nil
+	case TRACE_EXPORT_FILE:
+		if "" == M_trace_file {
+			return fmt.Errorf("trace_exporter [file] requires trace_file")
+		}
+	case TRACE_EXPORT_HTTP:
+		if "" == M_trace_endpoint {
+			return fmt.Errorf("trace_exporter [http] requires trace_endpoint")
+		}
+	default:
+		return fmt.Errorf("Invalid trace_exporter [%s], expected file or http",
+			M_trace_exporter)
+	}
+
+	ac.TpLogInfo("Tracing enabled, spans exported to %s [%s%s]",
+		M_trace_exporter, M_trace_file, M_trace_endpoint)
+
+	M_trace_spans = make(chan *traceSpan, TRACE_QUEUE)
+	M_trace_done = make(chan bool)
+
+	go traceExporter(M_trace_spans)
+
+	return nil
+}
+
+//Flush queued spans (shutdown)
+//@param ac	ATMI Context
+func stopTrace(ac *atmi.ATMICtx) {
+
+	M_trace_mutex.Lock()
+	spans := M_trace_spans
+	M_trace_spans = nil
+	M_trace_mutex.Unlock()
+
+	if nil == spans {
+		return
+	}
+
+	close(spans)
+	<-M_trace_done
+
+	if M_trace_dropped > 0 {
+		ac.TpLogWarn("Spans dropped (export queue full): %d", M_trace_dropped)
+	}
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
@@ -0,0 +1,373 @@
+/**
+ * @brief WebSocket routes (conv "websocket"): messages are called as XATMI
+ *  services, subscribed events are pushed to the client
+ *
+ * @file websocket.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	atmi "github.com/endurox-dev/endurox-go"
+	"github.com/gorilla/websocket"
+)
+
+//WebSocket connection settings
+const (
+	WS_WRITE_WAIT    = 10 * time.Second //Time allowed to write a message
+	WS_PONG_WAIT     = 60 * time.Second //Time allowed to get pong from client
+	WS_PING_INTERVAL = 50 * time.Second //Must be less than WS_PONG_WAIT
+	WS_CONV_DEFAULT  = "json2ubf"
+)
+
+//Resolve WebSocket route settings
+//@param svc	Service map
+//@return error or nil
+func initWebSocket(svc *ServiceMap) error {
+
+	if CONV_WEBSOCKET != svc.Conv_int {
+		return nil
+	}
+
+	if "" == svc.Ws_conv {
+		svc.Ws_conv = WS_CONV_DEFAULT
+	}
+
+	switch svc.Ws_conv_int = M_convs[svc.Ws_conv]; svc.Ws_conv_int {
+	case CONV_JSON2UBF, CONV_JSON, CONV_TEXT:
+	default:
+		return fmt.Errorf("Route [%s]: invalid ws_conv [%s] (json2ubf, json "+
+			"or text supported)", svc.Url, svc.Ws_conv)
+	}
+
+	if "" == svc.Svc && !svc.Echo && "" == svc.Ev_mask {
+		return fmt.Errorf("Route [%s]: 'websocket' conv needs 'svc', 'echo' "+
+			"or 'ev_mask'", svc.Url)
+	}
+
+	return nil
+}
+
+//Format error message for the WebSocket client. Text conversion uses
+//errfmt_text, others JSON with errfmt_json_code and errfmt_json_msg.
+//@param svc	Service map
+//@param err	ATMI error
+//@return message
+func wsErrorMsg(svc *ServiceMap, err atmi.ATMIError) []byte {
+
+	if CONV_TEXT == svc.Ws_conv_int {
+		return []byte(fmt.Sprintf(svc.Errfmt_text, err.Code(), err.Message()))
+	}
+
+	return []byte(fmt.Sprintf("{%s,%s}",
+		fmt.Sprintf(svc.Errfmt_json_code, err.Code()),
+		fmt.Sprintf(svc.Errfmt_json_msg, err.Message())))
+}
+
+//Convert WebSocket message to XATMI buffer, install request fields
+//@param ac	ATMI Context
+//@param svc	Service map
+//@param msg	message received
+//@param fields	additional request fields
+//@return buffer or error
+func wsRequestBuf(ac *atmi.ATMICtx, svc *ServiceMap, msg []byte,
+	fields map[string][]string) (atmi.TypedBuffer, atmi.ATMIError) {
+
+	switch svc.Ws_conv_int {
+	case CONV_JSON2UBF:
+		bufu, err := ac.NewUBF(atmi.ATMIMsgSizeMax())
+
+		if nil != err {
+			return nil, err
+		}
+
+		if err1 := bufu.TpJSONToUBF(string(msg)); nil != err1 {
+			ac.TpLogError("Failed to convert JSON to UBF: %s", err1.Message())
+			return nil, atmi.NewCustomATMIError(atmi.TPEINVAL,
+				"Failed to convert JSON to UBF: "+err1.Message())
+		}
+
+		if err1 := UBFInstallFields(ac, bufu, fields); nil != err1 {
+			return nil, atmi.NewCustomATMIError(atmi.TPEINVAL, err1.Message())
+		}
+
+		return bufu, nil
+	case CONV_JSON:
+		if len(fields) > 0 {
+			var jsonObj interface{}
+
+			if err := json.Unmarshal(msg, &jsonObj); nil != err {
+				ac.TpLogError("Failed to unmarshal JSON: %s", err.Error())
+				return nil, atmi.NewCustomATMIError(atmi.TPEINVAL,
+					"Invalid JSON object")
+			}
+
+			obj, ok := jsonObj.(map[string]interface{})
+
+			if !ok {
+				ac.TpLogError("JSON message is not an object")
+				return nil, atmi.NewCustomATMIError(atmi.TPEINVAL,
+					"JSON message is not an object")
+			}
+
+			JSONInstallFields(obj, fields)
+			msg, _ = json.Marshal(obj)
+		}
+
+		bufj, err := ac.NewJSON(msg)
+
+		if nil != err {
+			return nil, err
+		}
+
+		return bufj, nil
+	}
+
+	bufs, err := ac.NewString(string(msg))
+
+	if nil != err {
+		return nil, err
+	}
+
+	return bufs, nil
+}
+
+//Convert XATMI reply buffer to WebSocket message
+//@param ac	ATMI Context
+//@param svc	Service map
+//@param buf	reply buffer
+//@return message or error
+func wsReplyMsg(ac *atmi.ATMICtx, svc *ServiceMap,
+	buf atmi.TypedBuffer) ([]byte, atmi.ATMIError) {
+
+	if CONV_TEXT == svc.Ws_conv_int {
+		if bufs, ok := buf.(*atmi.TypedString); ok {
+			return []byte(bufs.GetString()), nil
+		}
+	}
+
+	return bufferToJSON(ac, buf)
+}
+
+//Process single WebSocket message: call the service and prepare the reply
+//@param s	stream session
+//@param svc	Service map
+//@param msg	message received
+//@param fields	additional request fields
+//@return reply message, nil if no reply is sent
+func wsCall(s *streamSession, svc *ServiceMap, msg []byte,
+	fields map[string][]string) []byte {
+
+	var flags int64 = 0
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ac := s.ac
+
+	buf, err := wsRequestBuf(ac, svc, msg, fields)
+
+	if nil != err {
+		return wsErrorMsg(svc, err)
+	}
+
+	if svc.Notime {
+		flags |= atmi.TPNOTIME
+	}
+
+	if svc.Echo {
+		ac.TpLogInfo("Echo mode - replying with request")
+	} else if svc.Asynccall {
+		if _, err = ac.TpACall(svc.Svc, buf, flags|atmi.TPNOREPLY); nil != err {
+			ac.TpLogError("Failed to tpacall [%s]: %s", svc.Svc, err.Message())
+			return wsErrorMsg(svc, err)
+		}
+
+		if !svc.Asyncecho {
+			return nil
+		}
+	} else if _, err = ac.TpCall(svc.Svc, buf, flags); nil != err {
+		ac.TpLogError("Failed to call [%s]: %s", svc.Svc, err.Message())
+		return wsErrorMsg(svc, err)
+	}
+
+	rsp, err := wsReplyMsg(ac, svc, buf)
+
+	if nil != err {
+		return wsErrorMsg(svc, err)
+	}
+
+	return rsp
+}
+
+//Serve WebSocket route. Request is authenticated before the upgrade, then
+//messages are processed in order with the connection's own XATMI context.
+//Events (if subscribed) are sent as {"event":<event buffer JSON>}.
+//@param svc	Service map
+//@param w	Response writer
+//@param req	HTTP Request
+func serveWebSocket(svc *ServiceMap, w http.ResponseWriter, req *http.Request) {
+
+	fields := make(map[string][]string)
+
+	if !streamAccept(svc, w, req, fields) {
+		return
+	}
+
+	s, err := openStream(svc)
+
+	if nil != err {
+		rejectRequest(svc, w, err)
+		return
+	}
+
+	defer s.close()
+
+	upgrader := websocket.Upgrader{}
+
+	//Otherwise only same origin is accepted
+	if len(svc.Cors_origins) > 0 {
+		upgrader.CheckOrigin = func(r *http.Request) bool {
+			ok, _ := corsOriginAllowed(svc, r.Header.Get("Origin"))
+			return ok
+		}
+	}
+
+	conn, errU := upgrader.Upgrade(w, req, nil)
+
+	if nil != errU {
+		//Upgrader has responded with error
+		M_ac.TpLogError("URL [%s] WebSocket upgrade failed: %s",
+			req.URL, errU.Error())
+		return
+	}
+
+	defer conn.Close()
+
+	M_ac.TpLogInfo("URL [%s] WebSocket connected: %s", req.URL, req.RemoteAddr)
+
+	if limit := maxBodySize(svc); limit > 0 {
+		conn.SetReadLimit(int64(limit))
+	}
+
+	conn.SetReadDeadline(time.Now().Add(WS_PONG_WAIT))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(WS_PONG_WAIT))
+	})
+
+	msgType := websocket.TextMessage
+	replies := make(chan []byte)
+	done := make(chan bool)
+	writerDone := make(chan bool)
+
+	go s.pollEvents(done)
+
+	//All writes are done here
+	go func() {
+
+		defer close(writerDone)
+		//Unblock the reader on write failure or shutdown
+		defer conn.Close()
+
+		ping := time.NewTicker(WS_PING_INTERVAL)
+		defer ping.Stop()
+
+		for {
+			var msg []byte
+
+			select {
+			case <-done:
+				return
+			case <-M_streams_stop:
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway,
+						"Server shutdown"), time.Now().Add(WS_WRITE_WAIT))
+				return
+			case <-ping.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil,
+					time.Now().Add(WS_WRITE_WAIT)); nil != err {
+					return
+				}
+				continue
+			case msg = <-replies:
+			case ev := <-s.events:
+				msg = []byte(fmt.Sprintf("{\"event\":%s}", ev))
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(WS_WRITE_WAIT))
+
+			if err := conn.WriteMessage(msgType, msg); nil != err {
+				return
+			}
+		}
+	}()
+
+	//Writer and events polling are terminated also in case of panic
+	defer func() {
+		close(done)
+		<-writerDone
+	}()
+
+	for {
+		_, msg, errR := conn.ReadMessage()
+
+		if nil != errR {
+			if websocket.IsUnexpectedCloseError(errR, websocket.CloseGoingAway,
+				websocket.CloseNormalClosure) {
+				M_ac.TpLogWarn("URL [%s] WebSocket read failed: %s",
+					req.URL, errR.Error())
+			}
+			break
+		}
+
+		if "" == svc.Svc && !svc.Echo {
+			M_ac.TpLogWarn("URL [%s] no service for WebSocket messages - "+
+				"message dropped", req.URL)
+			continue
+		}
+
+		M_ac.TpLogDump(atmi.LOG_DEBUG, "WebSocket message received", msg, len(msg))
+
+		if rsp := wsCall(s, svc, msg, fields); nil != rsp {
+			select {
+			case replies <- rsp:
+			case <-writerDone:
+			}
+		}
+	}
+
+	M_ac.TpLogInfo("URL [%s] WebSocket disconnected: %s", req.URL, req.RemoteAddr)
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
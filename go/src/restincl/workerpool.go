@@ -40,6 +40,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"ubftab"
 
@@ -67,6 +69,45 @@ var M_freechan chan int //List of free channels submitted by wokers
 
 var M_ctxs []*atmi.ATMICtx //List of contexts
 
+var M_queue_wait_max int    //Max time to wait for free context, ms (0 - forever)
+var M_queue_len_max int32   //Max number of requests waiting for context (0 - no limit)
+var M_queue_len int32       //Number of requests waiting for context
+var M_queue_rejected uint64 //Number of requests rejected by queue limits
+
+//ATMI error with explicit HTTP status code, used for requests rejected by
+//gateway it self (authentication, limits, etc.). The status is returned
+//regardless of the error handling mode.
+type HTTPError struct {
+	atmi.ATMIError
+	Status     int
+	Violations []SchemaViolation //Request schema failures, added to response
+}
+
+//Create ATMI error with HTTP status
+//@param code	ATMI error code
+//@param msg	error message
+//@param status	HTTP status code
+//@return error object
+func NewHTTPError(code int, msg string, status int) *HTTPError {
+	return &HTTPError{ATMIError: atmi.NewCustomATMIError(code, msg), Status: status}
+}
+
+//Main context usage lock for requests rejected before getting worker context
+var M_reject_mutex sync.Mutex
+
+//Respond with error to request rejected before it got worker context
+//(e.g. authentication, limits). Main context is used for response generation.
+//@param svc	Service map
+//@param w	Response writer
+//@param err	Error to respond with
+func rejectRequest(svc *ServiceMap, w http.ResponseWriter, err atmi.ATMIError) {
+
+	M_reject_mutex.Lock()
+	defer M_reject_mutex.Unlock()
+
+	genRsp(M_ac, nil, svc, w, err, false)
+}
+
 //Generate response in the service configured way...
 //@w	handler for writting response to
 func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
@@ -76,6 +117,12 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 	var err atmi.ATMIError
 	/*	application/json */
 	rspType := "text/plain"
+	httpCode := http.StatusOK
+	herr, isHTTPErr := atmiErr.(*HTTPError)
+
+	if isHTTPErr {
+		httpCode = herr.Status
+	}
 	// Header and Cookies fields to delete from buffer
 	delFldList := []int{ubftab.EX_IF_REQHN,
 		ubftab.EX_IF_REQHV,
@@ -105,23 +152,32 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 		err = atmi.NewCustomATMIError(atmi.TPMINVAL, "SUCCEED")
 	} else {
 		err = atmiErr
+		metricsATMIError(svc, err.Code())
 	}
 
+	svc.Trace.setResult(err.Code(), err.Message())
+	svc.Access.setResult(err.Code())
+
 	//Generate response accordingly...
 	ac.TpLogDebug("Conv %d errors %d", svc.Conv_int, svc.Errors_int)
 
 	switch svc.Conv_int {
-	case CONV_JSON2UBF:
+	case CONV_JSON2UBF, CONV_XML2UBF, CONV_SOAP:
 		rspType = "application/json"
+
+		if CONV_XML2UBF == svc.Conv_int {
+			rspType = svc.Xml_content_type
+		} else if CONV_SOAP == svc.Conv_int {
+			rspType = soapContentType(svc)
+		}
 		//Convert buffer back to JSON & send it back..
 		//But we could append the buffer with error here...
 
 		bufu, ok := buf.(*atmi.TypedUBF)
 
 		if svc.Asynccall && !svc.Asyncecho {
-			if svc.Errors_int == ERRORS_JSON2UBF {
-				rsp = []byte(fmt.Sprintf("{\"EX_IF_ECODE\":%d,\"EX_IF_EMSG\":\"%s\"}",
-					err.Code(), err.Message()))
+			if isUBFErrors(svc) {
+				rsp = ubfErrorRsp(ac, svc, err.Code(), err.Message())
 			}
 		} else if !ok {
 			ac.TpLogError("Failed to cast TypedBuffer to TypedUBF!")
@@ -131,13 +187,13 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 				err = atmi.NewCustomATMIError(atmi.TPESYSTEM, "Invalid buffer")
 			}
 
-			if svc.Errors_int == ERRORS_JSON2UBF {
-				rsp = []byte(fmt.Sprintf("{\"EX_IF_ECODE\":%d,\"EX_IF_EMSG\":\"%s\"}",
-					err.Code(), err.Message()))
+			if isUBFErrors(svc) {
+				rsp = ubfErrorRsp(ac, svc, err.Code(), err.Message())
 			}
 		} else {
 
-			if svc.Errors_int == ERRORS_JSON2UBF {
+			//SOAP returns the error code in the Fault
+			if isUBFErrors(svc) && ERRORS_SOAP != svc.Errors_int {
 				ac.TpLogInfo("Setting JSON2UBF buffer error codes to: %d/%s",
 					err.Code(), err.Message())
 
@@ -282,7 +338,16 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 			// Delete Header and Cookie data from buffer (req&rsp)
 			bufu.BDelete(delFldList)
 
-			ret, err1 := bufu.TpUBFToJSON()
+			var ret string
+			var err1 atmi.UBFError
+
+			if CONV_XML2UBF == svc.Conv_int {
+				ret, err1 = UBFToXML(ac, svc, bufu)
+			} else if CONV_SOAP == svc.Conv_int {
+				ret, err1 = UBFToSOAP(ac, svc, bufu, err.Code(), err.Message())
+			} else {
+				ret, err1 = bufu.TpUBFToJSON()
+			}
 
 			if nil == err1 {
 				//Generate the resposne buffer...
@@ -293,9 +358,8 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 					err = err1
 				}
 
-				if svc.Errors_int == ERRORS_JSON2UBF {
-					rsp = []byte(fmt.Sprintf("{\"EX_IF_ECODE\":%d,\"EX_IF_EMSG\":\"%s\"}",
-						err1.Code(), err1.Message()))
+				if isUBFErrors(svc) {
+					rsp = ubfErrorRsp(ac, svc, err1.Code(), err1.Message())
 				}
 
 			}
@@ -499,6 +563,11 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 		break
 	}
 
+	//Faults are sent with HTTP 500 (or 400 for SOAP 1.2 Sender faults)
+	if ERRORS_SOAP == svc.Errors_int && !isHTTPErr {
+		httpCode = soapHTTPStatus(svc, err.Code())
+	}
+
 	//OK Now if all ok, there is stuff in buffer (from JSONUBF) it will
 	//be there in any case, thus we do not handle that
 
@@ -514,19 +583,19 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 
 		estr := strconv.Itoa(err.Code())
 
-		httpCode := 500
-
-		if 0 != lookup[estr] {
-			httpCode = lookup[estr]
-		} else {
-			httpCode = lookup["*"]
+		//Status given by gateway is kept as is
+		if !isHTTPErr {
+			if 0 != lookup[estr] {
+				httpCode = lookup[estr]
+			} else {
+				httpCode = lookup["*"]
+			}
 		}
 
 		//Generate error response and pop out of the funcion
 		if 200 != httpCode {
 			ac.TpLogWarn("Mapped response: tp %d -> http %d",
 				err.Code(), httpCode)
-			w.WriteHeader(httpCode)
 		}
 
 		break
@@ -587,12 +656,20 @@ func genRsp(ac *atmi.ATMICtx, buf atmi.TypedBuffer, svc *ServiceMap,
 		break
 	}
 
+	if isHTTPErr && len(herr.Violations) > 0 {
+		rsp = addViolations(svc, rsp, herr.Violations)
+	}
+
 	//Send response back
 	ac.TpLogDebug("Returning context type: %s, len: %d", rspType, len(rsp))
 	ac.TpLogDump(atmi.LOG_DEBUG, "Sending response back", rsp, len(rsp))
 	w.Header().Set("Content-Length", strconv.Itoa(len(rsp)))
 	w.Header().Set("Content-Type", rspType)
 
+	if http.StatusOK != httpCode {
+		w.WriteHeader(httpCode)
+	}
+
 	w.Write(rsp)
 }
 
@@ -608,16 +685,77 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter, req
 	reqlogOpen := false
 	ac.TpLog(atmi.LOG_DEBUG, "Got URL [%s], caller: %s", req.URL, req.RemoteAddr)
 
-	if "" != svc.Svc || svc.Echo {
+	if svc.Compress {
+		cw := newCompressWriter(svc, w, req)
+		defer cw.finish()
+		w = cw
+	}
+
+	if "" != svc.Svc || svc.Echo || CONV_SOAP == svc.Conv_int {
+
+		//Additional fields to install in request buffer
+		fields := make(map[string][]string)
 
-		body, _ := ioutil.ReadAll(req.Body)
+		if "" != svc.Authsvc {
+			if err = callAuthSvc(ac, svc, w, req, fields); nil != err {
+				genRsp(ac, nil, svc, w, err, false)
+				return atmi.FAIL
+			}
+		}
+
+		if err = decodeRequestBody(ac, req); nil != err {
+			genRsp(ac, nil, svc, w, err, false)
+			return atmi.FAIL
+		}
+
+		if err = limitRequestBody(ac, svc, w, req); nil != err {
+			genRsp(ac, nil, svc, w, err, false)
+			return atmi.FAIL
+		}
+
+		//Form must be parsed before the body is consumed
+		if svc.Parseform {
+			if err1 := parseFormParams(ac, svc, req); nil != err1 {
+				genRsp(ac, nil, svc, w, err1, false)
+				return atmi.FAIL
+			}
+		}
+
+		body, errR := ioutil.ReadAll(req.Body)
+
+		if nil != errR {
+			ac.TpLogError("Failed to read request body: %s", errR.Error())
+
+			if bodyLimitExceeded(req) {
+				genRsp(ac, nil, svc, w, errBodyTooLarge(), false)
+			} else {
+				genRsp(ac, nil, svc, w, NewHTTPError(atmi.TPEINVAL,
+					"Failed to read request body", http.StatusBadRequest), false)
+			}
+
+			return atmi.FAIL
+		}
+
+		//Validate JSON before conversion (form requests may have no body)
+		if nil != svc.Schema_sch &&
+			!(svc.Parseform && "" == strings.TrimSpace(string(body))) {
+			if err = validateSchema(ac, svc, body); nil != err {
+				genRsp(ac, nil, svc, w, err, false)
+				return atmi.FAIL
+			}
+		}
+
+		getPathParams(svc, req, fields)
+		getTLSClientFields(ac, svc, req, fields)
+		getAuthFields(svc, svc.Auth_res, fields)
+		getTraceFields(svc, fields)
 
 		ac.TpLogDebug("Requesting service [%s] buffer [%s]", svc.Svc, string(body))
 
 		//Prepare outgoing buffer...
 		switch svc.Conv_int {
-		case CONV_JSON2UBF:
-			//Convert JSON 2 UBF...
+		case CONV_JSON2UBF, CONV_XML2UBF, CONV_SOAP:
+			//Convert JSON (or XML, SOAP) 2 UBF...
 			//Bug #200, use max buffer size
 			bufu, err1 := ac.NewUBF(atmi.ATMIMsgSizeMax())
 
@@ -651,7 +789,40 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter, req
 				}
 			}
 
-			if err1 := bufu.TpJSONToUBF(string(body)); err1 != nil {
+			//With form parsing, no JSON body is allowed (GET or form post)
+			if svc.Parseform && "" == strings.TrimSpace(string(body)) {
+				ac.TpLogDebug("Empty body - JSON conversion skipped")
+			} else if CONV_SOAP == svc.Conv_int {
+				sr := getSOAPRequest(svc)
+
+				if err1 := SOAPToUBF(ac, sr, bufu, body); err1 != nil {
+					ac.TpLogError("Failed req: [%s]", string(body))
+					genRsp(ac, nil, svc, w, err1, false)
+					return atmi.FAIL
+				}
+
+				if !svc.Echo {
+					if svc.Svc = soapService(svc, sr); "" == svc.Svc {
+						ac.TpLogError("No service for SOAP action [%s] operation [%s]",
+							sr.Action, sr.Op)
+						genRsp(ac, nil, svc, w, atmi.NewCustomATMIError(atmi.TPENOENT,
+							"No service for SOAP operation "+sr.Op), false)
+						return atmi.FAIL
+					}
+
+					ac.TpLogInfo("SOAP request routed to [%s]", svc.Svc)
+				}
+			} else if CONV_XML2UBF == svc.Conv_int {
+				if err1 := XMLToUBF(ac, bufu, body); err1 != nil {
+					ac.TpLogError("Failed to convert from XML to UBF %d:[%s]\n",
+						err1.Code(), err1.Message())
+
+					ac.TpLogError("Failed req: [%s]", string(body))
+
+					genRsp(ac, nil, svc, w, err1, false)
+					return atmi.FAIL
+				}
+			} else if err1 := bufu.TpJSONToUBF(string(body)); err1 != nil {
 				ac.TpLogError("Failed to conver from JSON to UBF %d:[%s]\n",
 					err1.Code(), err1.Message())
 
@@ -660,7 +831,14 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter, req
 				genRsp(ac, nil, svc, w, err1, false)
 				return atmi.FAIL
 			}
-			if svc.Format == "r" || svc.Format == "regexp" {
+
+			if svc.Parseform {
+				if err1 := UBFInstallFormParams(ac, svc, req, bufu); nil != err1 {
+					genRsp(ac, nil, svc, w, err1, false)
+					return atmi.FAIL
+				}
+			}
+			if isRegexpFormat(svc) {
 				if id, err := ac.BFldId(svc.UrlField); err == nil && id != 0 {
 					ac.TpLogInfo("Setting field: [%d] with value [%s]", id, req.URL.Path)
 					bufu.BAdd(id, req.URL.Path)
@@ -670,6 +848,11 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter, req
 				}
 			}
 
+			if err1 := UBFInstallFields(ac, bufu, fields); nil != err1 {
+				genRsp(ac, nil, svc, w, err1, false)
+				return atmi.FAIL
+			}
+
 			buf = bufu
 			break
 		case CONV_JSON2VIEW:
@@ -689,6 +872,11 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter, req
 				return atmi.FAIL
 			}
 
+			if err1 := VIEWInstallFields(ac, bufv, fields); nil != err1 {
+				genRsp(ac, bufv, svc, w, err1, false)
+				return atmi.FAIL
+			}
+
 			buf = bufv
 			break
 		case CONV_TEXT:
@@ -734,20 +922,31 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter, req
 				return atmi.FAIL
 			}
 
-			if svc.Format == "r" || svc.Format == "regexp" {
+			if isRegexpFormat(svc) || len(fields) > 0 {
 				var jsonObj interface{}
 				if err := json.Unmarshal([]byte(bufj.GetJSON()), &jsonObj); err != nil {
 					ac.TpLogError("Failed to unmarshal JSON: %v", err.Error())
 					return atmi.FAIL
 				}
-				obj := jsonObj.(map[string]interface{})
+				obj, ok := jsonObj.(map[string]interface{})
 
-				if svc.UrlField != "" {
-					obj[svc.UrlField] = req.URL.Path
-				} else {
-					obj["EX_IF_URL"] = req.URL.Path
+				if !ok {
+					ac.TpLogError("JSON request is not an object")
+					genRsp(ac, nil, svc, w, atmi.NewCustomATMIError(atmi.TPEINVAL,
+						"JSON request is not an object"), false)
+					return atmi.FAIL
 				}
 
+				if isRegexpFormat(svc) {
+					if svc.UrlField != "" {
+						obj[svc.UrlField] = req.URL.Path
+					} else {
+						obj["EX_IF_URL"] = req.URL.Path
+					}
+				}
+
+				JSONInstallFields(obj, fields)
+
 				if barr, err2 := json.Marshal(obj); err2 == nil {
 					if err = bufj.SetJSON(barr); err != nil {
 						ac.TpLogError("Failed to set JSON: %v", err.Error())
@@ -810,6 +1009,63 @@ func handleMessage(ac *atmi.ATMICtx, svc *ServiceMap, w http.ResponseWriter, req
 	return atmi.SUCCEED
 }
 
+//Get free ATMI context for the request. If all contexts are busy, request
+//waits in the queue up to queue_wait_max, if queue is full (queue_len_max)
+//or wait time is exceeded, 503 is sent to the caller.
+//@param svc	Service map
+//@param w	Response writer
+//@param req	HTTP Request
+//@return context number and true if got, false if request is rejected
+func getFreeContext(svc *ServiceMap, w http.ResponseWriter, req *http.Request) (int, bool) {
+
+	//Fast path - free context available
+	select {
+	case nr := <-M_freechan:
+		return nr, true
+	default:
+	}
+
+	if M_queue_len_max > 0 {
+		if atomic.AddInt32(&M_queue_len, 1) > M_queue_len_max {
+			atomic.AddInt32(&M_queue_len, -1)
+			atomic.AddUint64(&M_queue_rejected, 1)
+			M_ac.TpLogWarn("URL [%s] caller %s: request queue full (%d), "+
+				"rejecting", req.URL, req.RemoteAddr, M_queue_len_max)
+			rejectRequest(svc, w, NewHTTPError(atmi.TPELIMIT,
+				"Request queue full", http.StatusServiceUnavailable))
+			return atmi.FAIL, false
+		}
+	} else {
+		atomic.AddInt32(&M_queue_len, 1)
+	}
+
+	defer atomic.AddInt32(&M_queue_len, -1)
+
+	var timeout <-chan time.Time
+
+	if M_queue_wait_max > 0 {
+		timer := time.NewTimer(time.Duration(M_queue_wait_max) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case nr := <-M_freechan:
+		return nr, true
+	case <-timeout:
+		atomic.AddUint64(&M_queue_rejected, 1)
+		M_ac.TpLogWarn("URL [%s] caller %s: no free context within %d ms, "+
+			"rejecting", req.URL, req.RemoteAddr, M_queue_wait_max)
+		rejectRequest(svc, w, NewHTTPError(atmi.TPETIME,
+			"No free worker available", http.StatusServiceUnavailable))
+	case <-req.Context().Done():
+		M_ac.TpLogWarn("URL [%s] caller %s: client gone while waiting "+
+			"for free context", req.URL, req.RemoteAddr)
+	}
+
+	return atmi.FAIL, false
+}
+
 //Initialise channels and work pools
 func initPool(ac *atmi.ATMICtx) error {
 
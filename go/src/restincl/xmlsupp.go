@@ -0,0 +1,307 @@
+/**
+ * @brief XML <-> UBF conversion (xml2ubf)
+ *
+ * @file xmlsupp.go
+ */
+/* -----------------------------------------------------------------------------
+ * Enduro/X Middleware Platform for Distributed Transaction Processing
+ * Copyright (C) 2009-2016, ATR Baltic, Ltd. All Rights Reserved.
+ * Copyright (C) 2017-2018, Mavimax, Ltd. All Rights Reserved.
+ * This software is released under one of the following licenses:
+ * AGPL or Mavimax's license for commercial use.
+ * -----------------------------------------------------------------------------
+ * AGPL license:
+ * 
+ * This program is free software; you can redistribute it and/or modify it under
+ * the terms of the GNU Affero General Public License, version 3 as published
+ * by the Free Software Foundation;
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A
+ * PARTICULAR PURPOSE. See the GNU Affero General Public License, version 3
+ * for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License along 
+ * with this program; if not, write to the Free Software Foundation, Inc., 
+ * 59 Temple Place, Suite 330, Boston, MA 02111-1307 USA
+ *
+ * -----------------------------------------------------------------------------
+ * A commercial use license is available from Mavimax, Ltd
+ * contact@mavimax.com
+ * -----------------------------------------------------------------------------
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Defaults
+const (
+	XML_ROOT_DEFAULT         = "UBF"
+	XML_CONTENT_TYPE_DEFAULT = "application/xml"
+)
+
+//Check if route uses UBF error fields (EX_IF_ECODE/EX_IF_EMSG) in response
+//@param svc	Service map
+//@return true if json2ubf, xml2ubf or soap errors
+func isUBFErrors(svc *ServiceMap) bool {
+	return ERRORS_JSON2UBF == svc.Errors_int || ERRORS_XML2UBF == svc.Errors_int ||
+		ERRORS_SOAP == svc.Errors_int
+}
+
+//Generate error response without buffer
+//@param ac	ATMI Context
+//@param svc	Service map
+//@param code	error code
+//@param msg	error message
+//@return response body in route's format
+func ubfErrorRsp(ac *atmi.ATMICtx, svc *ServiceMap, code int, msg string) []byte {
+
+	if CONV_SOAP == svc.Conv_int {
+		rsp, _ := UBFToSOAP(ac, svc, nil, code, msg)
+		return []byte(rsp)
+	} else if CONV_XML2UBF == svc.Conv_int {
+		var b bytes.Buffer
+		xmlStartRoot(&b, svc)
+		fmt.Fprintf(&b, "<EX_IF_ECODE>%d</EX_IF_ECODE><EX_IF_EMSG>", code)
+		xml.EscapeText(&b, []byte(msg))
+		b.WriteString("</EX_IF_EMSG>")
+		xmlEndRoot(&b, svc)
+		return b.Bytes()
+	}
+
+	return []byte(fmt.Sprintf("{\"EX_IF_ECODE\":%d,\"EX_IF_EMSG\":\"%s\"}",
+		code, msg))
+}
+
+//Write XML declaration and root element start
+//@param b	output buffer
+//@param svc	Service map
+func xmlStartRoot(b *bytes.Buffer, svc *ServiceMap) {
+
+	b.WriteString(xml.Header)
+	b.WriteString("<" + svc.Xml_root)
+
+	if "" != svc.Xml_ns {
+		b.WriteString(" xmlns=\"")
+		xml.EscapeText(b, []byte(svc.Xml_ns))
+		b.WriteString("\"")
+	}
+
+	b.WriteString(">")
+}
+
+//Write root element end
+//@param b	output buffer
+//@param svc	Service map
+func xmlEndRoot(b *bytes.Buffer, svc *ServiceMap) {
+	b.WriteString("</" + svc.Xml_root + ">")
+}
+
+//Load field value to UBF buffer, carray values are expected in base64
+//@param ac	ATMI Context
+//@param buf	UBF buffer
+//@param name	field name
+//@param value	field value
+//@return UBF error or nil
+func xmlAddField(ac *atmi.ATMICtx, buf *atmi.TypedUBF, name string,
+	value string) atmi.UBFError {
+
+	id, err := ac.BFldId(name)
+
+	if nil != err {
+		ac.TpLogError("XML element [%s] is not UBF field: %s", name, err.Message())
+		return err
+	}
+
+	if atmi.BFLD_CARRAY == ac.BFldType(id) {
+
+		data, errB := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+
+		if nil != errB {
+			ac.TpLogError("Invalid base64 in [%s]: %s", name, errB.Error())
+			return atmi.NewCustomUBFError(atmi.BEINVAL,
+				fmt.Sprintf("Invalid base64 data for field [%s]", name))
+		}
+
+		return buf.BAdd(id, data)
+	}
+
+	return buf.BAdd(id, value)
+}
+
+//Load child elements of the current element as UBF fields, up to the end
+//of the current element. Repeated elements are loaded as occurrences.
+//@param ac	ATMI Context
+//@param dec	XML decoder, positioned after the container start element
+//@param buf	UBF buffer
+//@return UBF error or nil
+func xmlDecodeFields(ac *atmi.ATMICtx, dec *xml.Decoder,
+	buf *atmi.TypedUBF) atmi.UBFError {
+
+	depth := 0
+	field := ""
+	var value strings.Builder
+
+	for {
+		tok, err := dec.Token()
+
+		if nil != err {
+			ac.TpLogError("Failed to parse XML: %s", err.Error())
+			return atmi.NewCustomUBFError(atmi.BSYNTAX,
+				"Failed to parse XML: "+err.Error())
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+
+			if 1 == depth {
+				field = t.Name.Local
+				value.Reset()
+			} else {
+				ac.TpLogError("Nested XML element [%s] in [%s] not supported",
+					t.Name.Local, field)
+				return atmi.NewCustomUBFError(atmi.BEINVAL,
+					fmt.Sprintf("Nested XML element [%s] not supported", t.Name.Local))
+			}
+		case xml.CharData:
+			if 1 == depth {
+				value.Write(t)
+			}
+		case xml.EndElement:
+			if 0 == depth {
+				return nil
+			}
+
+			if err := xmlAddField(ac, buf, field, value.String()); nil != err {
+				return err
+			}
+			depth--
+		}
+	}
+}
+
+//Check that rest of the document is well formed
+//@param ac	ATMI Context
+//@param dec	XML decoder
+//@return UBF error or nil
+func xmlDecodeEnd(ac *atmi.ATMICtx, dec *xml.Decoder) atmi.UBFError {
+
+	for {
+		if _, err := dec.Token(); io.EOF == err {
+			return nil
+		} else if nil != err {
+			ac.TpLogError("Failed to parse XML: %s", err.Error())
+			return atmi.NewCustomUBFError(atmi.BSYNTAX,
+				"Failed to parse XML: "+err.Error())
+		}
+	}
+}
+
+//Convert XML to UBF. Children of the root element are UBF fields, repeated
+//elements are loaded as occurrences.
+//@param ac	ATMI Context
+//@param buf	UBF buffer
+//@param data	XML document
+//@return UBF error or nil
+func XMLToUBF(ac *atmi.ATMICtx, buf *atmi.TypedUBF, data []byte) atmi.UBFError {
+
+	dec := xml.NewDecoder(bytes.NewReader(data))
+
+	for {
+		tok, err := dec.Token()
+
+		if io.EOF == err {
+			//Empty document
+			return nil
+		} else if nil != err {
+			ac.TpLogError("Failed to parse XML: %s", err.Error())
+			return atmi.NewCustomUBFError(atmi.BSYNTAX,
+				"Failed to parse XML: "+err.Error())
+		}
+
+		if _, ok := tok.(xml.StartElement); ok {
+			break
+		}
+	}
+
+	if err := xmlDecodeFields(ac, dec, buf); nil != err {
+		return err
+	}
+
+	return xmlDecodeEnd(ac, dec)
+}
+
+//Write UBF fields as XML elements. Each field occurrence is rendered as
+//element, carray fields are base64 encoded.
+//@param ac	ATMI Context
+//@param b	output buffer
+//@param buf	UBF buffer
+//@return UBF error or nil
+func xmlWriteFields(ac *atmi.ATMICtx, b *bytes.Buffer,
+	buf *atmi.TypedUBF) atmi.UBFError {
+
+	for id, occ, err := buf.BNext(true); nil == err && atmi.BBADFLDID != id; id, occ, err = buf.BNext(false) {
+
+		name, errN := ac.BFname(id)
+
+		if nil != errN {
+			return errN
+		}
+
+		var value string
+
+		if atmi.BFLD_CARRAY == ac.BFldType(id) {
+			data, errG := buf.BGetByteArr(id, occ)
+
+			if nil != errG {
+				return errG
+			}
+
+			value = base64.StdEncoding.EncodeToString(data)
+		} else {
+			var errG atmi.UBFError
+
+			if value, errG = buf.BGetString(id, occ); nil != errG {
+				return errG
+			}
+		}
+
+		b.WriteString("<" + name + ">")
+		xml.EscapeText(b, []byte(value))
+		b.WriteString("</" + name + ">")
+	}
+
+	return nil
+}
+
+//Convert UBF to XML
+//@param ac	ATMI Context
+//@param svc	Service map
+//@param buf	UBF buffer
+//@return XML document or error
+func UBFToXML(ac *atmi.ATMICtx, svc *ServiceMap, buf *atmi.TypedUBF) (string, atmi.UBFError) {
+
+	var b bytes.Buffer
+
+	xmlStartRoot(&b, svc)
+
+	if err := xmlWriteFields(ac, &b, buf); nil != err {
+		return "", err
+	}
+
+	xmlEndRoot(&b, svc)
+
+	return b.String(), nil
+}
+
+/* vim: set ts=4 sw=4 et smartindent: */
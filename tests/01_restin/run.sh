@@ -42,6 +42,12 @@ rm localhost* 2>/dev/null
 # Generate new ceritificate
 ./gencert.sh localhost 
 
+# EC keys and JWKS for JWT tests
+rm ec256.pem ec384.pem jwks-ec.json 2>/dev/null
+openssl ecparam -name prime256v1 -genkey -noout -out ec256.pem
+openssl ecparam -name secp384r1 -genkey -noout -out ec384.pem
+../../src/jwttool/jwttool jwks ec256.pem ec384.pem > jwks-ec.json
+
 . settest1
 
 # So we are in runtime directory
@@ -540,8 +546,119 @@ https://localhost:8080/svc1`
 	fi
 done
 } >> $LOGFILE 2>&1
+
+###############################################################################
+echo "TLS client certificate forwarding"
+###############################################################################
+{
+FPRINT=`openssl x509 -in conf/localhost.crt -noout -fingerprint -sha256 | \
+	cut -d= -f2 | tr -d ':' | tr 'A-F' 'a-f'`
+for i in {1..100}
+do
+	RSP=`curl -s --insecure --cert conf/localhost.crt --key conf/localhost.key \
+		-H "Content-Type: application/json" -X POST -d "{\"string\":\"TLS\"}" \
+		https://localhost:8080/tls/echo`
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != *"CN=localhost"* || "X$RSP" != *"\"fingerprint\":\"$FPRINT\""* ]]; then
+		echo "Invalid response received, got: [$RSP], expected: [CN=localhost] and [$FPRINT]"
+		go_out 48
+	fi
+done
+
+# Certificate fields sent by client without certificate are not forwarded
+RSP=`curl -s --insecure -H "Content-Type: application/json" -X POST \
+	-d "{\"string\":\"TLS\",\"subject\":\"CN=partner\",\"fingerprint\":\"00\"}" \
+	https://localhost:8080/tls/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" == *"CN=partner"* || "X$RSP" == *"fingerprint"* ]]; then
+	echo "Spoofed certificate fields forwarded, got: [$RSP]"
+	go_out 106
+fi
+
+# Extra occurrences sent by client are removed
+RSP=`curl -s --insecure --cert conf/localhost.crt --key conf/localhost.key \
+	-H "Content-Type: application/json" -X POST \
+	-d "{\"T_STRING_FLD\":[\"CN=partner\",\"CN=partner\"]}" \
+	https://localhost:8080/tls/ubf/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" == *"CN=partner"* || "X$RSP" != *"CN=localhost"* ]]; then
+	echo "Spoofed certificate field occurrences forwarded, got: [$RSP]"
+	go_out 107
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Graceful shutdown - in-flight request completes"
+###############################################################################
+{
+rm drain.out 2>/dev/null
+curl -s --insecure -H "Content-Type: application/json" -X POST -d \
+"{\"T_CHAR_FLD\":\"D\"}" https://localhost:8080/longop/ok > drain.out &
+CPID=$!
+# Let the request reach the service
+sleep 1
+} >> $LOGFILE 2>&1
+
 unset NDRX_CCTAG
 kill -2 $RPID
+
+{
+# Readiness fails, but requests are accepted during drain_grace
+sleep 0.5
+RSP=`curl -s -w " %{http_code}" http://localhost:8081/readyz`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != "XNOT READY"*" 503" ]]; then
+	echo "Invalid response received, got: [$RSP], expected: [NOT READY 503]"
+	go_out 105
+fi
+
+RSP=`curl -s --insecure -w " %{http_code}" https://localhost:8080/healthz`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != "XOK"*" 200" ]]; then
+	echo "Request not served in grace period, got: [$RSP]"
+	go_out 113
+fi
+
+# After drain_grace new connections are refused
+sleep 1.5
+curl -s --insecure -o /dev/null https://localhost:8080/healthz
+RET=$?
+
+if [ $RET -ne 7 ]; then
+	echo "Expected connection refused after grace period, curl exit: $RET"
+	go_out 114
+fi
+
+# Admin listener is open until drain is complete
+RSP=`curl -s -w " %{http_code}" http://localhost:8081/readyz`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != "XNOT READY"*" 503" ]]; then
+	echo "Admin readiness not served while draining, got: [$RSP]"
+	go_out 115
+fi
+
+wait $CPID
+RSP=`cat drain.out`
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"\"T_CHAR_2_FLD\":\"D\""* ]]; then
+	echo "Invalid response received, got: [$RSP], expected: [T_CHAR_2_FLD] set"
+	go_out 47
+fi
+} >> $LOGFILE 2>&1
+
 sleep 10
 
 # Start the non ssl version
@@ -1251,6 +1368,1247 @@ http://localhost:8080/header/cookies`
 		go_out 4
 	fi
 done
+###############################################################################
+echo "HTTP method routing test"
+###############################################################################
+{
+for i in {1..100}
+do
+	RSP=`(curl -s -H "Content-Type: text/plain" -X GET\
+		-d "Hello from curl" http://localhost:8080/methods 2>&1 )`
+
+	RSP_EXPECTED="Hello from EnduroX"
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != "X$RSP_EXPECTED" ]]; then
+		echo "Invalid response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 40
+	fi
+
+	RSP=`(curl -s -H "Content-Type: text/plain" -X POST\
+		-d "Hello from curl" http://localhost:8080/methods 2>&1 )`
+
+	RSP_EXPECTED="11:"
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != *"$RSP_EXPECTED"* ]]; then
+		echo "Invalid response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 41
+	fi
+
+	RSP=`(curl -s -i -H "Content-Type: text/plain" -X PUT\
+		-d "Hello from curl" http://localhost:8080/methods 2>&1 )`
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != *"405"* || "X$RSP" != *"Allow: GET, POST"* ]]; then
+		echo "Invalid response received, got: [$RSP], expected: [405] and [Allow: GET, POST]"
+		go_out 42
+	fi
+done
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Path parameters test"
+###############################################################################
+{
+for i in {1..100}
+do
+	RSP=`curl -s -H "Content-Type: application/json" -X POST -d \
+"{\"string\":\"TEMPLATE\"}" \
+http://localhost:8080/tpl/json/ACC1/tx/77`
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != *"\"account\":\"ACC1\""* || "X$RSP" != *"\"txid\":\"77\""* ]]; then
+		echo "Invalid response received, got: [$RSP], expected: [account] and [txid] keys"
+		go_out 43
+	fi
+
+	RSP=`curl -s -H "Content-Type: application/json" -X POST -d \
+"{\"string\":\"TEMPLATE\"}" \
+http://localhost:8080/tpl/json/ACC1/tx/abc`
+
+	RSP_EXPECTED="404 page not found"
+	echo "Response: [$RSP]"
+
+	if [ "X$RSP" != "X$RSP_EXPECTED" ]; then
+		echo "Invalid response received, got: [$RSP], expected: [$RSP_EXPECTED]"
+		go_out 44
+	fi
+done
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Query string and form mapping test"
+###############################################################################
+{
+for i in {1..100}
+do
+	RSP=`curl -s "http://localhost:8080/form/echo?q=HELLO&q=WORLD&SHORT_FLD=77"`
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != *"\"T_SHORT_FLD\":77"* || \
+		"X$RSP" != *"\"T_STRING_FLD\":[\"HELLO\",\"WORLD\"]"* ]]; then
+		echo "Invalid response received, got: [$RSP], expected: [T_SHORT_FLD] and [T_STRING_FLD]"
+		go_out 45
+	fi
+
+	RSP=`curl -s -X POST -d "q=FORM&LONG_FLD=123456" http://localhost:8080/form/echo`
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != *"\"T_LONG_FLD\":123456"* || \
+		"X$RSP" != *"\"T_STRING_FLD\":\"FORM\""* ]]; then
+		echo "Invalid response received, got: [$RSP], expected: [T_LONG_FLD] and [T_STRING_FLD]"
+		go_out 46
+	fi
+done
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "API key authentication"
+###############################################################################
+{
+for i in {1..100}
+do
+	CODE=`curl -s -o /dev/null -w "%{http_code}" -H "Content-Type: application/json" \
+		-X POST -d "{\"string\":\"AUTH\"}" http://localhost:8080/auth/apikey`
+
+	if [ "X$CODE" != "X401" ]; then
+		echo "Expected 401 without key, got: [$CODE]"
+		go_out 49
+	fi
+
+	CODE=`curl -s -o /dev/null -w "%{http_code}" -H "X-API-Key: k3y-0002-test" \
+		-H "Content-Type: application/json" \
+		-X POST -d "{\"string\":\"AUTH\"}" http://localhost:8080/auth/apikey`
+
+	if [ "X$CODE" != "X403" ]; then
+		echo "Expected 403 for not allowed principal, got: [$CODE]"
+		go_out 50
+	fi
+
+	RSP=`curl -s -H "X-API-Key: k3y-0001-test" -H "Content-Type: application/json" \
+		-X POST -d "{\"string\":\"AUTH\"}" http://localhost:8080/auth/apikey`
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != *"\"principal\":\"alice\""* ]]; then
+		echo "Invalid response received, got: [$RSP], expected: [\"principal\":\"alice\"]"
+		go_out 51
+	fi
+done
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Authorization service"
+###############################################################################
+{
+for i in {1..100}
+do
+	CODE=`curl -s -o /dev/null -w "%{http_code}" -H "Content-Type: application/json" \
+		-X POST -d "{\"string\":\"AUTH\"}" http://localhost:8080/auth/svc`
+
+	if [ "X$CODE" != "X401" ]; then
+		echo "Expected 401 without token, got: [$CODE]"
+		go_out 52
+	fi
+
+	CODE=`curl -s -o /dev/null -w "%{http_code}" -H "X-Token: bad" \
+		-H "Content-Type: application/json" \
+		-X POST -d "{\"string\":\"AUTH\"}" http://localhost:8080/auth/svc`
+
+	if [ "X$CODE" != "X403" ]; then
+		echo "Expected 403 for bad token, got: [$CODE]"
+		go_out 53
+	fi
+
+	RSP=`curl -s -H "X-Token: good" -H "Content-Type: application/json" \
+		-X POST -d "{\"string\":\"AUTH\"}" http://localhost:8080/auth/svc`
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != *"\"entitlement\":\"ENT-POST\""* ]]; then
+		echo "Invalid response received, got: [$RSP], expected: [\"entitlement\":\"ENT-POST\"]"
+		go_out 54
+	fi
+done
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Rate limiting"
+###############################################################################
+{
+LIMITED=0
+for i in {1..5}
+do
+	HDR=`curl -s -D - -o /dev/null -X POST -d "RATE" http://localhost:8080/ratelimit`
+
+	echo "Headers: [$HDR]"
+
+	if [[ "X$HDR" == *" 429 "* ]]; then
+
+		if [[ "X$HDR" != *"Retry-After: "* ]]; then
+			echo "Missing Retry-After header in 429 response"
+			go_out 55
+		fi
+
+		LIMITED=$((LIMITED+1))
+	fi
+done
+
+if [ $LIMITED -lt 1 ]; then
+	echo "Expected at least one request to be rate limited"
+	go_out 56
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Worker pool exhaustion - 503"
+###############################################################################
+{
+# Occupy all workers (10) with long running requests
+PIDS=""
+for i in {1..10}
+do
+	curl -s -H "Content-Type: application/json" -X POST -d "{\"T_CHAR_FLD\":\"Q\"}" \
+		http://localhost:8080/longop/ok > /dev/null &
+	PIDS="$PIDS $!"
+done
+
+sleep 1
+
+RSP=`curl -s -w " %{http_code}" -H "Content-Type: application/json" \
+	-X POST -d "{\"T_STRING_FLD\":\"QUEUE\"}" http://localhost:8080/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *" 503" || "X$RSP" != *"\"error_code\":13"* ]]; then
+	echo "Invalid response received, got: [$RSP], expected: [503] with TPETIME"
+	go_out 57
+fi
+
+wait $PIDS
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Metrics endpoint"
+###############################################################################
+{
+curl -s -H "Content-Type: application/json" -X POST -d "{\"T_STRING_FLD\":\"M\"}" \
+	http://localhost:8080/echo > /dev/null
+
+RSP=`curl -s http://localhost:8081/metrics`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"restincl_requests_total{route=\"/echo\",method=\"POST\",code=\"200\"}"* || \
+	"X$RSP" != *"restincl_request_duration_seconds_count{route=\"/echo\"}"* || \
+	"X$RSP" != *"restincl_workers 10"* ]]; then
+	echo "Invalid metrics received, got: [$RSP]"
+	go_out 58
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Health & readiness endpoints"
+###############################################################################
+{
+RSP=`curl -s -w " %{http_code}" http://localhost:8080/healthz`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != "XOK"*" 200" ]]; then
+	echo "Invalid response received, got: [$RSP], expected: [OK 200]"
+	go_out 59
+fi
+
+RSP=`curl -s -w " %{http_code}" http://localhost:8081/readyz`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != "XREADY"*" 200" ]]; then
+	echo "Invalid response received, got: [$RSP], expected: [READY 200]"
+	go_out 60
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "CORS"
+###############################################################################
+{
+HDR=`curl -s -D - -o /dev/null -X OPTIONS -H "Origin: https://app.example.com" \
+	-H "Access-Control-Request-Method: POST" http://localhost:8080/cors/echo`
+
+echo "Headers: [$HDR]"
+
+if [[ "X$HDR" != *" 204 "* || \
+	"X$HDR" != *"Access-Control-Allow-Origin: https://app.example.com"* || \
+	"X$HDR" != *"Access-Control-Max-Age: 600"* ]]; then
+	echo "Invalid preflight response: [$HDR]"
+	go_out 61
+fi
+
+HDR=`curl -s -D - -o /dev/null -X OPTIONS -H "Origin: https://evil.com" \
+	-H "Access-Control-Request-Method: POST" http://localhost:8080/cors/echo`
+
+echo "Headers: [$HDR]"
+
+if [[ "X$HDR" != *" 403 "* ]]; then
+	echo "Expected 403 for not allowed origin: [$HDR]"
+	go_out 62
+fi
+
+HDR=`curl -s -D - -X POST -H "Origin: https://app.example.com" -d "CORS" \
+	http://localhost:8080/cors/echo`
+
+echo "Response: [$HDR]"
+
+if [[ "X$HDR" != *"Access-Control-Allow-Origin: https://app.example.com"* || \
+	"X$HDR" != *"CORS"* ]]; then
+	echo "Invalid CORS response: [$HDR]"
+	go_out 63
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Compression"
+###############################################################################
+{
+DATA=`printf 'COMPRESS%.0s' {1..50}`
+
+HDR=`curl -s -D - -o compress.out -H "Accept-Encoding: gzip" -X POST -d "$DATA" \
+	http://localhost:8080/compress/echo`
+
+echo "Headers: [$HDR]"
+
+if [[ "X$HDR" != *"Content-Encoding: gzip"* ]]; then
+	echo "Response is not gzip compressed: [$HDR]"
+	go_out 64
+fi
+
+RSP=`gzip -dc compress.out`
+
+if [ "X$RSP" != "X$DATA" ]; then
+	echo "Invalid decompressed response, got: [$RSP], expected: [$DATA]"
+	go_out 65
+fi
+
+# Compressed request
+RSP=`printf "$DATA" | gzip -c | curl -s -H "Content-Encoding: gzip" -X POST \
+	--data-binary @- http://localhost:8080/compress/echo`
+
+if [ "X$RSP" != "X$DATA" ]; then
+	echo "Invalid response to gzip request, got: [$RSP], expected: [$DATA]"
+	go_out 66
+fi
+
+rm compress.out
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Request body size limit"
+###############################################################################
+{
+DATA=`printf 'X%.0s' {1..200}`
+
+RSP=`curl -s -w " %{http_code}" -X POST -d "$DATA" http://localhost:8080/limit/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *" 413" ]]; then
+	echo "Expected 413 for too large body, got: [$RSP]"
+	go_out 67
+fi
+
+# Chunked body without Content-Length
+RSP=`printf "$DATA" | curl -s -w " %{http_code}" -H "Transfer-Encoding: chunked" \
+	-X POST --data-binary @- http://localhost:8080/limit/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *" 413" ]]; then
+	echo "Expected 413 for too large chunked body, got: [$RSP]"
+	go_out 68
+fi
+
+RSP=`curl -s -X POST -d "SMALL" http://localhost:8080/limit/echo`
+
+if [ "X$RSP" != "XSMALL" ]; then
+	echo "Invalid response received, got: [$RSP], expected: [SMALL]"
+	go_out 69
+fi
+
+# Body of exactly max_body_size is accepted, also when chunked
+DATA=`printf 'X%.0s' {1..100}`
+RSP=`printf "$DATA" | curl -s -H "Transfer-Encoding: chunked" \
+	-X POST --data-binary @- http://localhost:8080/limit/echo`
+
+if [ "X$RSP" != "X$DATA" ]; then
+	echo "Body of max_body_size not accepted, got: [$RSP]"
+	go_out 122
+fi
+
+RSP=`printf "${DATA}X" | curl -s -w " %{http_code}" -H "Transfer-Encoding: chunked" \
+	-X POST --data-binary @- http://localhost:8080/limit/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *" 413" ]]; then
+	echo "Expected 413 for body one byte over the limit, got: [$RSP]"
+	go_out 123
+fi
+
+# Body cut by the client is not reported as too large
+limit_stats() {
+	curl -s http://localhost:8081/metrics | \
+		grep '^restincl_requests_total{route="/limit/echo",method="POST"' | \
+		awk '{ all += $2 } /code="413"/ { big += $2 } END { print all+0, big+0 }'
+}
+
+BEFORE=`limit_stats`
+exec 3<>/dev/tcp/localhost/8080
+printf 'POST /limit/echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 50\r\n\r\nSHORT' >&3
+exec 3>&-
+sleep 1
+AFTER=`limit_stats`
+
+echo "Requests, 413s before: [$BEFORE] after: [$AFTER]"
+
+if [ "X$AFTER" != "X$(( ${BEFORE% *} + 1 )) ${BEFORE#* }" ]; then
+	echo "Cut body must be counted and not rejected with 413"
+	go_out 124
+fi
+} >> $LOGFILE 2>&1
+
+
+###############################################################################
+echo "XML to UBF conversion"
+###############################################################################
+{
+RSP=`curl -s -H "Content-Type: application/xml" -X POST \
+	-d "<req><T_STRING_FLD>A</T_STRING_FLD><T_STRING_FLD>B</T_STRING_FLD></req>" \
+	http://localhost:8080/xml/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"<Data>"*"<T_STRING_FLD>A</T_STRING_FLD><T_STRING_FLD>B</T_STRING_FLD>"*"</Data>"* ]]; then
+	echo "Invalid XML response, got: [$RSP]"
+	go_out 70
+fi
+
+# Malformed document
+RSP=`curl -s -H "Content-Type: application/xml" -X POST \
+	-d "<req><T_STRING_FLD>A</req>" http://localhost:8080/xml/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"<EX_IF_ECODE>"* ]]; then
+	echo "Expected XML error response, got: [$RSP]"
+	go_out 71
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "SOAP envelope"
+###############################################################################
+{
+RSP=`curl -s -H "Content-Type: text/xml" -H "SOAPAction: \"urn:test/Pay\"" -X POST \
+	-d '<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body><m:Pay xmlns:m="urn:test"><T_STRING_FLD>A</T_STRING_FLD></m:Pay></soap:Body></soap:Envelope>' \
+	http://localhost:8080/soap/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *'<PayResponse xmlns="urn:test"><T_STRING_FLD>A</T_STRING_FLD></PayResponse>'* ]]; then
+	echo "Invalid SOAP response, got: [$RSP]"
+	go_out 72
+fi
+
+# Service not available -> Client fault
+RSP=`curl -s -w " %{http_code}" -H "Content-Type: text/xml" -H "SOAPAction: \"urn:test/Pay\"" -X POST \
+	-d '<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body><m:Pay xmlns:m="urn:test"><T_STRING_FLD>A</T_STRING_FLD></m:Pay></soap:Body></soap:Envelope>' \
+	http://localhost:8080/soap/svc`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"<faultcode>soap:Client</faultcode>"*" 500" ]]; then
+	echo "Expected SOAP 1.1 Client fault, got: [$RSP]"
+	go_out 73
+fi
+
+# SOAP 1.2, operation not mapped -> Sender fault
+RSP=`curl -s -w " %{http_code}" -H "Content-Type: application/soap+xml" -X POST \
+	-d '<env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope"><env:Body><m:Other xmlns:m="urn:test"/></env:Body></env:Envelope>' \
+	http://localhost:8080/soap/svc`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"<soap:Value>soap:Sender</soap:Value>"*" 400" ]]; then
+	echo "Expected SOAP 1.2 Sender fault, got: [$RSP]"
+	go_out 74
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "OpenAPI document"
+###############################################################################
+{
+RSP=`curl -s -w " %{http_code}" http://localhost:8080/openapi.json`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *'"openapi": "3.0.3"'*'"/view/ok"'*" 200" ]]; then
+	echo "Invalid OpenAPI document, got: [$RSP]"
+	go_out 75
+fi
+
+if [[ "X$RSP" != *'"REQUEST1"'* ]]; then
+	echo "VIEW REQUEST1 not described in OpenAPI document"
+	go_out 76
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "JSON Schema validation"
+###############################################################################
+{
+RSP=`curl -s -w " %{http_code}" -H "Content-Type: application/json" -X POST \
+	-d '{"T_STRING_FLD":"HELLO", "T_LONG_FLD":1}' http://localhost:8080/schema/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *'"T_STRING_FLD":"HELLO"'*" 200" ]]; then
+	echo "Valid request rejected, got: [$RSP]"
+	go_out 77
+fi
+
+RSP=`curl -s -w " %{http_code}" -H "Content-Type: application/json" -X POST \
+	-d '{"T_LONG_FLD":"X"}' http://localhost:8080/schema/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *'"violations":['*'"instance":"/T_LONG_FLD"'*" 400" ]]; then
+	echo "Expected 400 with violations, got: [$RSP]"
+	go_out 78
+fi
+
+if [[ "X$RSP" != *"missing properties"* ]]; then
+	echo "Expected missing T_STRING_FLD violation, got: [$RSP]"
+	go_out 79
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "WebSocket upgrade"
+###############################################################################
+{
+RSP=`curl -s -i --max-time 2 -H "Connection: Upgrade" -H "Upgrade: websocket" \
+	-H "Sec-WebSocket-Version: 13" -H "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==" \
+	http://localhost:8080/ws/echo | tr -d '\r'`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"HTTP/1.1 101"*"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo="* ]]; then
+	echo "WebSocket upgrade failed, got: [$RSP]"
+	go_out 80
+fi
+
+RSP=`curl -s -w " %{http_code}" http://localhost:8080/ws/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *" 400" ]]; then
+	echo "Expected 400 for plain request, got: [$RSP]"
+	go_out 81
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "WebSocket messages"
+###############################################################################
+{
+WSCLIENT=../src/wsclient/wsclient
+
+# JSON buffer, path parameter installed, null is rejected and connection is kept
+RSP=`$WSCLIENT ws://localhost:8080/ws/json/R1 '{"msg":"HELLO"}' 'null' '[1]' \
+	'{"msg":"AGAIN"}'`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *'"msg":"HELLO"'*'"room":"R1"'*'not an object'*'not an object'*'"msg":"AGAIN"'* ]]; then
+	echo "Invalid JSON WebSocket replies, got: [$RSP]"
+	go_out 108
+fi
+
+# JSON to UBF conversion
+RSP=`$WSCLIENT ws://localhost:8080/ws/ubf '{"T_STRING_FLD":"WSUBF", "T_LONG_FLD":5}'`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *'"T_STRING_FLD":"WSUBF"'* || "X$RSP" != *'"T_LONG_FLD":5'* ]]; then
+	echo "Invalid json2ubf WebSocket reply, got: [$RSP]"
+	go_out 109
+fi
+
+# Events pushed to the connection
+$WSCLIENT -n 1 ws://localhost:8080/ws/events > ws.out &
+WS_PID=$!
+sleep 1
+
+curl -s -H "Content-Type: application/json" -X POST \
+	-d '{"T_STRING_FLD":"WSEVENT"}' http://localhost:8080/ev/post
+
+wait $WS_PID
+RSP=`cat ws.out`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *'{"event":{'*'"T_STRING_FLD":"WSEVENT"'* ]]; then
+	echo "WebSocket event not received, got: [$RSP]"
+	go_out 110
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Server-Sent Events"
+###############################################################################
+{
+# Subscribe & post events while stream is open
+curl -s -N -i --max-time 4 http://localhost:8080/sse/events > sse.out &
+CURL_PID=$!
+sleep 1
+
+RSP=`curl -s -H "Content-Type: application/json" -X POST \
+	-d '{"T_STRING_FLD":"EVENT1"}' http://localhost:8080/ev/post`
+echo "Post response: [$RSP]"
+
+RSP=`curl -s -H "Content-Type: application/json" -X POST \
+	-d '{"T_STRING_FLD":"EVENT2"}' http://localhost:8080/ev/post`
+echo "Post response: [$RSP]"
+
+wait $CURL_PID
+RSP=`cat sse.out | tr -d '\r'`
+rm -f sse.out
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"Content-Type: text/event-stream"*": heartbeat"* ]]; then
+	echo "Invalid SSE stream or no heartbeat, got: [$RSP]"
+	go_out 82
+fi
+
+if [[ "X$RSP" != *"id: 1"*'"EVENT1"'*"id: 2"*'"EVENT2"'* ]]; then
+	echo "Events not received, got: [$RSP]"
+	go_out 83
+fi
+
+# Resume after first event
+RSP=`curl -s -N --max-time 2 -H "Last-Event-ID: 1" http://localhost:8080/sse/events`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" == *"EVENT1"* || "X$RSP" != *'"EVENT2"'* ]]; then
+	echo "Resume from Last-Event-ID failed, got: [$RSP]"
+	go_out 84
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Static files"
+###############################################################################
+{
+RSP=`curl -s -i http://localhost:8080/ui/app.js | tr -d '\r'`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"HTTP/1.1 200"*"Cache-Control: public, max-age=3600"*"STATIC-APP"* ]]; then
+	echo "Invalid static file response, got: [$RSP]"
+	go_out 85
+fi
+
+ETAG=`echo "$RSP" | grep "^Etag: " | cut -d ' ' -f 2`
+echo "ETag: [$ETAG]"
+
+RSP=`curl -s -w " %{http_code}" -H "If-None-Match: $ETAG" http://localhost:8080/ui/app.js`
+
+echo "Response: [$RSP]"
+
+if [[ "X$ETAG" == "X" || "X$RSP" != "X 304" ]]; then
+	echo "Expected 304 for matching ETag, got: [$RSP]"
+	go_out 86
+fi
+
+# Single page app route gets index
+RSP=`curl -s -w " %{http_code}" http://localhost:8080/ui/accounts/123`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"STATIC-INDEX"*" 200" ]]; then
+	echo "Expected index for SPA route, got: [$RSP]"
+	go_out 87
+fi
+
+RSP=`curl -s -w " %{http_code}" http://localhost:8080/ui/missing.png`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *" 404" ]]; then
+	echo "Expected 404 for missing file, got: [$RSP]"
+	go_out 88
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Additional listener"
+###############################################################################
+{
+RSP=`curl -s -w " %{http_code}" -H "X-API-Key: k3y-0001-test" \
+	-X POST -d "HELLO" http://localhost:8082/limit/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != "XHELLO 200" ]]; then
+	echo "Route not served by additional listener, got: [$RSP]"
+	go_out 89
+fi
+
+RSP=`curl -s -w " %{http_code}" -X POST -d "HELLO" http://localhost:8082/limit/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *" 401" ]]; then
+	echo "Expected 401 without API key, got: [$RSP]"
+	go_out 90
+fi
+
+RSP=`curl -s -w " %{http_code}" -H "X-API-Key: k3y-0001-test" \
+	-X POST -d "HELLO" http://localhost:8082/compress/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *" 404" ]]; then
+	echo "Route not listed for listener must not be served, got: [$RSP]"
+	go_out 91
+fi
+
+# Listener rejections are logged and measured as the route's requests
+if ! grep "\"route\":\"/limit/echo\"" log/access.log | grep -q "\"status\":401"; then
+	echo "Listener authentication failure not in log/access.log"
+	go_out 116
+fi
+
+if ! curl -s http://localhost:8081/metrics | grep -q \
+	'restincl_requests_total{route="/limit/echo",method="POST",code="401"}'; then
+	echo "Listener authentication failure not counted"
+	go_out 117
+fi
+
+# Listener principal is passed to the service, client value is replaced
+RSP=`curl -s -H "X-API-Key: k3y-0002-test" -H "Content-Type: application/json" \
+	-X POST -d '{"T_STRING_FLD":"WHO", "T_STRING_2_FLD":"alice"}' \
+	http://localhost:8082/listener/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *'"T_STRING_2_FLD":"bob"'* || "X$RSP" == *"alice"* ]]; then
+	echo "Listener principal not installed, got: [$RSP]"
+	go_out 118
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "HTTP/2 cleartext (h2c)"
+###############################################################################
+{
+if curl -V | grep -q HTTP2; then
+
+	RSP=`curl -s --http2-prior-knowledge -w " %{http_version}" \
+		-X POST -d "HELLO" http://localhost:8080/limit/echo`
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != "XHELLO 2" ]]; then
+		echo "Expected HTTP/2 response, got: [$RSP]"
+		go_out 92
+	fi
+else
+	echo "curl without HTTP/2 support - h2c test skipped"
+fi
+
+# HTTP/1.1 is still served
+RSP=`curl -s --http1.1 -w " %{http_version}" \
+	-X POST -d "HELLO" http://localhost:8080/limit/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != "XHELLO 1.1" ]]; then
+	echo "Expected HTTP/1.1 response, got: [$RSP]"
+	go_out 93
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Tracing"
+###############################################################################
+{
+TRACE_ID=4bf92f3577b34da6a3ce929d0e0e4736
+
+RSP=`curl -s -i -H "Content-Type: application/json" \
+	-H "traceparent: 00-$TRACE_ID-00f067aa0ba902b7-01" \
+	-X POST -d '{"T_LONG_FLD":1}' http://localhost:8080/trace/echo | tr -d '\r'`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"Traceparent: 00-$TRACE_ID-"* ]]; then
+	echo "Trace not continued in response header, got: [$RSP]"
+	go_out 94
+fi
+
+if [[ "X$RSP" != *"\"T_STRING_FLD\":\"$TRACE_ID\""* ]]; then
+	echo "Trace id not installed in request buffer, got: [$RSP]"
+	go_out 95
+fi
+
+# Let exporter flush
+sleep 2
+
+if ! grep -q "\"traceId\":\"$TRACE_ID\"" log/trace.json; then
+	echo "Span not exported to log/trace.json"
+	go_out 96
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Access log"
+###############################################################################
+{
+REQ_ID="req-test-$$"
+
+RSP=`curl -s -i -H "Content-Type: application/json" -H "X-Request-ID: $REQ_ID" \
+	-X POST -d '{"T_LONG_FLD":1}' http://localhost:8080/trace/echo | tr -d '\r'`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"X-Request-Id: $REQ_ID"* ]]; then
+	echo "Request id not returned in response header, got: [$RSP]"
+	go_out 97
+fi
+
+if ! grep "\"request_id\":\"$REQ_ID\"" log/access.log | \
+	grep "\"route\":\"/trace/echo\"" | grep -q "\"status\":200"; then
+	echo "Request not written to log/access.log"
+	go_out 98
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "JWT authentication"
+###############################################################################
+{
+b64url() {
+	openssl base64 -A | tr '+/' '-_' | tr -d '='
+}
+
+jwt() {
+	local hdr=`printf '{"alg":"HS256","kid":"test"}' | b64url`
+	local pay=`printf '%s' "$1" | b64url`
+	local sig=`printf '%s' "$hdr.$pay" | \
+		openssl dgst -sha256 -hmac test-secret -binary | b64url`
+	echo "$hdr.$pay.$sig"
+}
+
+TOKEN=`jwt '{"sub":"bob"}'`
+
+CODE=`curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $TOKEN" \
+	-H "Content-Type: application/json" \
+	-X POST -d "{\"string\":\"AUTH\"}" http://localhost:8080/auth/jwt`
+
+if [ "X$CODE" != "X401" ]; then
+	echo "Expected 401 for JWT without exp, got: [$CODE]"
+	go_out 99
+fi
+
+TOKEN=`jwt "{\"sub\":\"bob\",\"exp\":$(( $(date +%s) + 600 ))}"`
+
+RSP=`curl -s -H "Authorization: Bearer $TOKEN" -H "Content-Type: application/json" \
+	-X POST -d "{\"string\":\"AUTH\"}" http://localhost:8080/auth/jwt`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"\"principal\":\"bob\""* ]]; then
+	echo "Invalid response received, got: [$RSP], expected: [\"principal\":\"bob\"]"
+	go_out 100
+fi
+
+# Token without sub is rejected
+TOKEN=`jwt "{\"exp\":$(( $(date +%s) + 600 ))}"`
+
+CODE=`curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $TOKEN" \
+	-H "Content-Type: application/json" \
+	-X POST -d "{\"string\":\"AUTH\"}" http://localhost:8080/auth/jwt`
+
+if [ "X$CODE" != "X401" ]; then
+	echo "Expected 401 for JWT without sub, got: [$CODE]"
+	go_out 128
+fi
+
+# Unsigned token
+HDR=`printf '{"alg":"none","kid":"test"}' | b64url`
+PAY=`printf '{"sub":"bob","exp":%d}' $(( $(date +%s) + 600 )) | b64url`
+
+CODE=`curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $HDR.$PAY." \
+	-H "Content-Type: application/json" \
+	-X POST -d "{\"string\":\"AUTH\"}" http://localhost:8080/auth/jwt`
+
+if [ "X$CODE" != "X401" ]; then
+	echo "Expected 401 for alg none, got: [$CODE]"
+	go_out 129
+fi
+
+# EC signatures
+JWTTOOL=../src/jwttool/jwttool
+PAYLOAD="{\"sub\":\"carol\",\"exp\":$(( $(date +%s) + 600 ))}"
+
+for ALG in ES256 ES384; do
+
+	KEY=conf/ec256.pem
+	[ $ALG == ES384 ] && KEY=conf/ec384.pem
+
+	TOKEN=`$JWTTOOL sign $KEY $ALG "$PAYLOAD"`
+
+	RSP=`curl -s -H "Authorization: Bearer $TOKEN" -H "Content-Type: application/json" \
+		-X POST -d "{\"string\":\"AUTH\"}" http://localhost:8080/auth/jwt/ec`
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != *"\"principal\":\"carol\""* ]]; then
+		echo "Valid $ALG token not accepted, got: [$RSP]"
+		go_out 130
+	fi
+done
+
+# ES256 signed with P-384 key
+TOKEN=`$JWTTOOL sign conf/ec384.pem ES256 "$PAYLOAD"`
+
+CODE=`curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $TOKEN" \
+	-H "Content-Type: application/json" \
+	-X POST -d "{\"string\":\"AUTH\"}" http://localhost:8080/auth/jwt/ec`
+
+if [ "X$CODE" != "X401" ]; then
+	echo "Expected 401 for ES256 with P-384 key, got: [$CODE]"
+	go_out 131
+fi
+
+TOKEN=`$JWTTOOL sign -trunc conf/ec256.pem ES256 "$PAYLOAD"`
+
+CODE=`curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $TOKEN" \
+	-H "Content-Type: application/json" \
+	-X POST -d "{\"string\":\"AUTH\"}" http://localhost:8080/auth/jwt/ec`
+
+if [ "X$CODE" != "X401" ]; then
+	echo "Expected 401 for truncated signature, got: [$CODE]"
+	go_out 132
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Rate limit of method routes"
+###############################################################################
+{
+# GET and PUT share the route bucket of 2
+CODES=""
+for M in GET PUT GET
+do
+	CODE=`curl -s -o /dev/null -w "%{http_code}" -X $M -d "RL" \
+		http://localhost:8080/ratelimit/methods`
+	echo "$M: $CODE"
+	CODES="$CODES $CODE"
+done
+
+if [ "X$CODES" != "X 200 200 429" ]; then
+	echo "Expected route limit shared by methods, got: [$CODES]"
+	go_out 101
+fi
+
+# POST has own bucket
+CODE=`curl -s -o /dev/null -w "%{http_code}" -X POST -d "RL" \
+	http://localhost:8080/ratelimit/methods`
+
+if [ "X$CODE" != "X200" ]; then
+	echo "Expected POST served by own limit, got: [$CODE]"
+	go_out 102
+fi
+
+DUP=`curl -s http://localhost:8081/metrics | grep "^restincl_ratelimit_rejected_total" | \
+	sed 's/ [0-9]*$//' | sort | uniq -d`
+
+if [ "X$DUP" != "X" ]; then
+	echo "Duplicate rate limit metric series: [$DUP]"
+	go_out 103
+fi
+
+if ! curl -s http://localhost:8081/metrics | grep -q \
+	'restincl_ratelimit_rejected_total{route="/ratelimit/methods",scope="route"} 1'; then
+	echo "Rejection not counted on shared route limiter"
+	go_out 104
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Invalid error mapping of defaults fails the startup"
+###############################################################################
+{
+NDRX_CCTAG="BADERRMAP" timeout 20 restincl > ./log/restin-baderrmap.log 2>&1
+RET=$?
+
+if [ $RET -eq 0 ] || [ $RET -eq 124 ]; then
+	echo "restincl started with invalid errors_fmt_http_map (exit $RET)"
+	go_out 135
+fi
+
+if ! grep -q "Failed to parse http error code abc" ./log/restin-baderrmap.log; then
+	echo "Missing error mapping error in the log"
+	go_out 136
+fi
+
+# CORS settings are route level only
+NDRX_CCTAG="BADMETHOD" timeout 20 restincl > ./log/restin-badmethod.log 2>&1
+RET=$?
+
+if [ $RET -eq 0 ] || [ $RET -eq 124 ]; then
+	echo "restincl started with CORS key in method block (exit $RET)"
+	go_out 137
+fi
+
+if ! grep -q "is route level setting only" ./log/restin-badmethod.log; then
+	echo "Missing method block error in the log"
+	go_out 138
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Invalid route regexp fails the startup"
+###############################################################################
+{
+NDRX_CCTAG="BADREGEXP" timeout 20 restincl > ./log/restin-badregexp.log 2>&1
+RET=$?
+
+if [ $RET -eq 0 ] || [ $RET -eq 124 ]; then
+	echo "restincl started with invalid route regexp (exit $RET)"
+	go_out 133
+fi
+
+if ! grep -q "Failed to compile regexp" ./log/restin-badregexp.log; then
+	echo "Missing regexp error in the log"
+	go_out 134
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "CORS any origin with credentials fails the startup"
+###############################################################################
+{
+NDRX_CCTAG="BADCORS" timeout 20 restincl > ./log/restin-badcors.log 2>&1
+RET=$?
+
+if [ $RET -eq 0 ] || [ $RET -eq 124 ]; then
+	echo "restincl started with \"*\" origin and credentials (exit $RET)"
+	go_out 111
+fi
+
+if ! grep -q "cannot be used with cors_credentials" ./log/restin-badcors.log; then
+	echo "Missing CORS configuration error in the log"
+	go_out 112
+fi
+} >> $LOGFILE 2>&1
+
+###############################################################################
+echo "Main listener routes and authentication"
+###############################################################################
+xadmin sc -t RESTIN
+NDRX_CCTAG="LMAIN" restincl > ./log/restin-lmain.log 2>&1 &
+RPID=$!
+sleep 10
+{
+RSP=`curl -s -w " %{http_code}" -H "X-API-Key: k3y-0001-test" \
+	-X POST -d "HELLO" http://localhost:8080/limit/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != "XHELLO 200" ]]; then
+	echo "Route not served by main listener, got: [$RSP]"
+	kill -2 $RPID
+	go_out 119
+fi
+
+RSP=`curl -s -w " %{http_code}" -X POST -d "HELLO" http://localhost:8080/limit/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *" 401" ]]; then
+	echo "Expected 401 without API key on main listener, got: [$RSP]"
+	kill -2 $RPID
+	go_out 120
+fi
+
+RSP=`curl -s -w " %{http_code}" -H "X-API-Key: k3y-0001-test" \
+	-X POST -d "HELLO" http://localhost:8080/echo`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *" 404" ]]; then
+	echo "Route not listed for main listener must not be served, got: [$RSP]"
+	kill -2 $RPID
+	go_out 121
+fi
+} >> $LOGFILE 2>&1
+
+kill -2 $RPID
+wait $RPID
+xadmin bc -t RESTIN
+sleep 10
+
+###############################################################################
+echo "Global body limit, write time-out of streams"
+###############################################################################
+xadmin sc -t RESTIN
+NDRX_CCTAG="LIMITS" restincl > ./log/restin-limits.log 2>&1 &
+RPID=$!
+sleep 10
+{
+DATA=`printf 'X%.0s' {1..60}`
+
+RSP=`curl -s -w " %{http_code}" -X POST -d "$DATA" http://localhost:8080/limit/global`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *" 413" ]]; then
+	echo "Expected 413 by global max_body_size, got: [$RSP]"
+	kill -2 $RPID
+	go_out 125
+fi
+
+# Route's own limit takes precedence
+RSP=`curl -s -X POST -d "$DATA" http://localhost:8080/limit/echo`
+
+if [ "X$RSP" != "X$DATA" ]; then
+	echo "Route max_body_size not used, got: [$RSP]"
+	kill -2 $RPID
+	go_out 126
+fi
+
+# Heartbeat interval is longer than write_timeout, stream must stay open
+curl -s -N --max-time 7 http://localhost:8080/sse/slow > sse.out
+RET=$?
+BEATS=`grep -c "^: heartbeat" sse.out`
+
+echo "curl exit: $RET, heartbeats: $BEATS"
+
+if [ $RET -ne 28 ] || [ $BEATS -lt 2 ]; then
+	echo "SSE stream cut by write_timeout (curl exit $RET, heartbeats $BEATS)"
+	kill -2 $RPID
+	go_out 127
+fi
+} >> $LOGFILE 2>&1
+
+kill -2 $RPID
+wait $RPID
+xadmin bc -t RESTIN
+sleep 10
+
+###############################################################################
+echo "Streaming connection accounting"
+###############################################################################
+xadmin sc -t RESTIN
+NDRX_CCTAG="STREAMS" restincl > ./log/restin-streams.log 2>&1 &
+RPID=$!
+sleep 10
+{
+WSCLIENT=../src/wsclient/wsclient
+
+# Slot is released exactly once per connection
+for i in {1..5}; do
+	RSP=`$WSCLIENT ws://localhost:8080/ws/ubf '{"T_STRING_FLD":"SLOT"}'`
+
+	if [[ "X$RSP" != *'"T_STRING_FLD":"SLOT"'* ]]; then
+		echo "WebSocket call $i failed, got: [$RSP]"
+		kill -2 $RPID
+		go_out 139
+	fi
+done
+
+# Hold the only slot
+$WSCLIENT -n 1 -t 3 ws://localhost:8080/ws/events > ws.out &
+WS_PID=$!
+sleep 1
+
+RSP=`$WSCLIENT ws://localhost:8080/ws/ubf '{"T_STRING_FLD":"SLOT"}'`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *"HTTP 503"* ]]; then
+	echo "Expected 503 over stream_max, got: [$RSP]"
+	kill -2 $RPID
+	go_out 140
+fi
+
+wait $WS_PID
+sleep 1
+
+RSP=`$WSCLIENT ws://localhost:8080/ws/ubf '{"T_STRING_FLD":"SLOT"}'`
+
+echo "Response: [$RSP]"
+
+if [[ "X$RSP" != *'"T_STRING_FLD":"SLOT"'* ]]; then
+	echo "Slot not released, got: [$RSP]"
+	kill -2 $RPID
+	go_out 141
+fi
+} >> $LOGFILE 2>&1
+
+kill -2 $RPID
+wait $RPID
+xadmin bc -t RESTIN
+sleep 10
+
+###############################################################################
+echo "HTTP/2 disabled by TLS ciphers"
+###############################################################################
+xadmin sc -t RESTIN
+NDRX_CCTAG="TLSCIPH" restincl > ./log/restin-tlsciph.log 2>&1 &
+RPID=$!
+sleep 10
+{
+if ! grep -q "required by HTTP/2 - HTTP/2 disabled" ./log/restin-tlsciph.log; then
+	echo "Missing HTTP/2 cipher warning in the log"
+	kill -2 $RPID
+	go_out 142
+fi
+
+if curl -V | grep -q HTTP2; then
+
+	RSP=`curl -s --insecure --http2 -w " %{http_version}" \
+		-X POST -d "HELLO" https://localhost:8080/limit/echo`
+
+	echo "Response: [$RSP]"
+
+	if [[ "X$RSP" != "XHELLO 1.1" ]]; then
+		echo "Expected HTTP/1.1 response, got: [$RSP]"
+		kill -2 $RPID
+		go_out 143
+	fi
+else
+	echo "curl without HTTP/2 support - HTTP/2 negotiation test skipped"
+fi
+} >> $LOGFILE 2>&1
+
+kill -2 $RPID
+wait $RPID
+xadmin bc -t RESTIN
+sleep 10
+
 # go_out alreay doing stop
 #xadmin stop -c -y
 
@@ -0,0 +1,148 @@
+package main
+
+//JWT test tool for EC keys (PEM, as generated by openssl ecparam -genkey).
+//Key id is the key file name without extension.
+//Usage:
+//	jwttool jwks <key.pem> [key.pem...]	- print JWKS of public keys
+//	jwttool sign [-trunc] <key.pem> <alg> <payload>	- print signed token,
+//		-trunc drops last two bytes of the signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//Load EC private key
+//@param path	PEM file
+//@return key and key id
+func loadKey(path string) (*ecdsa.PrivateKey, string) {
+
+	data, err := ioutil.ReadFile(path)
+
+	if nil != err {
+		fail("Failed to read [%s]: %s", path, err.Error())
+	}
+
+	block, _ := pem.Decode(data)
+
+	if nil == block {
+		fail("No PEM data in [%s]", path)
+	}
+
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+
+	if nil != err {
+		fail("Invalid EC key [%s]: %s", path, err.Error())
+	}
+
+	kid := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	return key, kid
+}
+
+//Encode base64url without padding
+func b64url(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+//Print error and exit
+func fail(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	os.Exit(1)
+}
+
+//Print JWKS of the keys
+func jwks(paths []string) {
+
+	var keys []map[string]string
+
+	for _, path := range paths {
+
+		key, kid := loadKey(path)
+		size := (key.Curve.Params().BitSize + 7) / 8
+
+		keys = append(keys, map[string]string{"kty": "EC", "kid": kid,
+			"crv": key.Curve.Params().Name,
+			"x":   b64url(key.X.FillBytes(make([]byte, size))),
+			"y":   b64url(key.Y.FillBytes(make([]byte, size)))})
+	}
+
+	out, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	fmt.Println(string(out))
+}
+
+//Print signed token. Hash is given by alg, curve by key (may mismatch alg).
+func sign(path string, alg string, payload string, trunc bool) {
+
+	var ch crypto.Hash
+
+	switch alg {
+	case "ES256":
+		ch = crypto.SHA256
+	case "ES384":
+		ch = crypto.SHA384
+	case "ES512":
+		ch = crypto.SHA512
+	default:
+		fail("Unsupported algorithm [%s]", alg)
+	}
+
+	key, kid := loadKey(path)
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	signed := b64url(hdr) + "." + b64url([]byte(payload))
+
+	h := ch.New()
+	h.Write([]byte(signed))
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+
+	if nil != err {
+		fail("Failed to sign: %s", err.Error())
+	}
+
+	size := (key.Curve.Params().BitSize + 7) / 8
+	sig := append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+
+	if trunc {
+		sig = sig[:len(sig)-2]
+	}
+
+	fmt.Println(signed + "." + b64url(sig))
+}
+
+func main() {
+
+	args := os.Args[1:]
+
+	if len(args) > 1 && "jwks" == args[0] {
+		jwks(args[1:])
+	} else if len(args) > 0 && "sign" == args[0] {
+
+		trunc := len(args) > 1 && "-trunc" == args[1]
+
+		if trunc {
+			args = args[1:]
+		}
+
+		if 4 != len(args) {
+			fail("Usage: %s sign [-trunc] <key.pem> <alg> <payload>", os.Args[0])
+		}
+
+		sign(args[1], args[2], args[3], trunc)
+	} else {
+		fail("Usage: %s jwks <key.pem>... | sign [-trunc] <key.pem> <alg> <payload>",
+			os.Args[0])
+	}
+}
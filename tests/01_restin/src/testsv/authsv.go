@@ -0,0 +1,60 @@
+package main
+
+import (
+	"ubftab"
+
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Authorization service for restincl authsvc tests. Token is expected in
+//X-Token header: "good" is authorized, missing token gives 401, others 403
+//@param ac ATMI Context
+//@param svc Service call information
+func AUTHSV(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	ret := SUCCEED
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Return to the caller
+	defer func() {
+		if SUCCEED == ret {
+			ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+		} else {
+			ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+		}
+	}()
+
+	//Resize buffer, to have some more space
+	if err := ub.TpRealloc(1024); err != nil {
+		ac.TpLogError("TpRealloc() Got error: %d:[%s]\n", err.Code(), err.Message())
+		ret = FAIL
+		return
+	}
+
+	ub.TpLogPrintUBF(atmi.LOG_DEBUG, "Incoming auth request:")
+
+	token := ""
+	occs, _ := ub.BOccur(ubftab.EX_IF_REQHN)
+
+	for occ := 0; occ < occs; occ++ {
+		if name, _ := ub.BGetString(ubftab.EX_IF_REQHN, occ); "X-Token" == name {
+			token, _ = ub.BGetString(ubftab.EX_IF_REQHV, occ)
+		}
+	}
+
+	switch token {
+	case "good":
+		method, _ := ub.BGetString(ubftab.EX_IF_METHOD, 0)
+		ub.BChg(ubftab.T_STRING_3_FLD, 0, "ENT-"+method)
+	case "":
+		ub.BAdd(ubftab.EX_IF_RSPHN, "WWW-Authenticate")
+		ub.BAdd(ubftab.EX_IF_RSPHV, "Token")
+		ret = FAIL
+	default:
+		ret = FAIL
+	}
+
+	return
+}
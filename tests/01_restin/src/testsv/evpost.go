@@ -0,0 +1,34 @@
+package main
+
+import (
+	atmi "github.com/endurox-dev/endurox-go"
+)
+
+//Post the request buffer as TESTEV event (SSE, WebSocket tests)
+//@param ac ATMI Context
+//@param svc Service call information
+func EVPOST(ac *atmi.ATMICtx, svc *atmi.TPSVCINFO) {
+
+	ret := SUCCEED
+
+	//Get UBF Handler
+	ub, _ := ac.CastToUBF(&svc.Data)
+
+	//Return to the caller
+	defer func() {
+		if SUCCEED == ret {
+			ac.TpReturn(atmi.TPSUCCESS, 0, ub, 0)
+		} else {
+			ac.TpReturn(atmi.TPFAIL, 0, ub, 0)
+		}
+	}()
+
+	ub.TpLogPrintUBF(atmi.LOG_INFO, "Posting TESTEV event")
+
+	if _, err := ac.TpPost("TESTEV", ub, 0, 0); nil != err {
+		ac.TpLogError("Failed to post event: %s", err.Message())
+		ret = FAIL
+	}
+
+	return
+}
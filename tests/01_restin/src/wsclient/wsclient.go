@@ -0,0 +1,70 @@
+package main
+
+//WebSocket test client. Connects to given URL, sends the messages given in
+//command line (in order) and prints each message received to stdout, one per
+//line. Exits when expected number of messages is read or timeout expires.
+//Usage: wsclient [-n <messages to read>] [-t <timeout sec>] <url> [msg...]
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func main() {
+
+	count := flag.Int("n", -1, "Number of messages to read (default: number sent)")
+	timeout := flag.Int("t", 5, "Timeout in seconds")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-n count] [-t timeout] <url> [msg...]\n",
+			os.Args[0])
+		os.Exit(2)
+	}
+
+	msgs := flag.Args()[1:]
+
+	if *count < 0 {
+		*count = len(msgs)
+	}
+
+	conn, rsp, err := websocket.DefaultDialer.Dial(flag.Arg(0), nil)
+
+	if nil != err {
+		if nil != rsp {
+			fmt.Printf("HTTP %d\n", rsp.StatusCode)
+		}
+		fmt.Fprintf(os.Stderr, "Failed to connect: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Duration(*timeout) * time.Second))
+
+	for _, msg := range msgs {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); nil != err {
+			fmt.Fprintf(os.Stderr, "Failed to send: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	for i := 0; i < *count; i++ {
+
+		_, msg, err := conn.ReadMessage()
+
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "Failed to read: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		fmt.Println(string(msg))
+	}
+
+	conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}